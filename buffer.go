@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// a bufferError indicates that the contents of the buffer are invalid, as
+// opposed to the buffer being unreadable
+type bufferError struct {
+	// the 1-based line number the error applies to, or 0 if the error isn't
+	// specific to one line
+	line int
+	msg  string
+}
+
+func (e *bufferError) Error() string {
+	if e.line == 0 {
+		return e.msg
+	}
+
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+// annotationPrefix starts the comment lines that errors are written to the
+// buffer as, which are ignored when it's read back
+const annotationPrefix = "# error: "
+
+// numberWidth returns the number of digits that numbers are padded to in a
+// numbered buffer of n lines
+func numberWidth(n int) int {
+	width := len(strconv.Itoa(n))
+	if width < 4 {
+		return 4
+	}
+
+	return width
+}
+
+// writeBuffer writes a line to w for each of e's dsts, quoting those that
+// need it. If numbered is set, each line is prefixed with its 1-based index,
+// zero-padded to numberWidth, so that it can be identified even if lines are
+// reordered or removed, dsts that are deleted are left out, and creates are
+// written after the rest. deleted may be nil, if nothing is.
+func writeBuffer(w io.Writer, e edit, numbered bool) error {
+	bw := bufio.NewWriter(w)
+	width := numberWidth(len(e.dsts))
+
+	for i, dst := range e.dsts {
+		if numbered {
+			if e.deleted != nil && e.deleted[i] {
+				continue
+			}
+			fmt.Fprintf(bw, "%0*d ", width, i+1)
+		}
+		bw.WriteString(quote(dst, 0))
+		bw.WriteByte('\n')
+	}
+	if numbered {
+		for _, dst := range e.creates {
+			bw.WriteString(quote(dst, width))
+			bw.WriteByte('\n')
+		}
+	}
+
+	// errors are sticky, so this reports any from the writes above
+	return bw.Flush()
+}
+
+// an edit is the result of reading back the buffer after it's been edited
+type edit struct {
+	// dsts are the destinations of each src, indexed like srcs
+	dsts []string
+	// deleted marks the srcs whose lines were removed
+	deleted []bool
+	// creates are the paths of new entries that should be created, where
+	// those ending in a slash are directories
+	creates []string
+	// lines are the 1-based line numbers that dsts were read from, or 0 for
+	// those that are deleted, and createLines are those of creates. They're
+	// only set by readBuffer.
+	lines, createLines []int
+}
+
+// readBuffer reads the destination of each of srcs from r, which should
+// contain what writeBuffer wrote after it's been edited. When numbered is
+// set, entries whose lines were removed are marked as deleted, and their dsts
+// are left unchanged, while lines without numbers padded to numberWidth are
+// new entries to create.
+func readBuffer(r io.Reader, srcs []string, numbered bool) (edit, error) {
+	scanner := bufio.NewScanner(r)
+	var e edit
+
+	if !numbered {
+		e.dsts = make([]string, 0, len(srcs))
+		e.lines = make([]int, 0, len(srcs))
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := scanner.Text()
+			if strings.HasPrefix(text, annotationPrefix) {
+				continue
+			}
+
+			if len(e.dsts) >= len(srcs) {
+				return edit{}, &bufferError{msg: "tmpfile contains too many lines"}
+			}
+
+			dst, err := unquote(text)
+			if err != nil {
+				return edit{}, &bufferError{line: line, msg: err.Error()}
+			}
+			e.dsts = append(e.dsts, dst)
+			e.lines = append(e.lines, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return edit{}, err
+		}
+
+		// it can't contain too many because that would've caused an error
+		// above
+		if len(e.dsts) < len(srcs) {
+			return edit{}, &bufferError{msg: "tmpfile contains too few lines"}
+		}
+
+		e.deleted = make([]bool, len(srcs))
+		return e, nil
+	}
+
+	width := numberWidth(len(srcs))
+	e.dsts = make([]string, len(srcs))
+	copy(e.dsts, srcs)
+	e.lines = make([]int, len(srcs))
+	e.deleted = make([]bool, len(srcs))
+	for i := range e.deleted {
+		e.deleted[i] = true
+	}
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, annotationPrefix) {
+			continue
+		}
+
+		number, dst, ok := parseNumbered(text, width)
+		if !ok {
+			dst, err := unquote(text)
+			if err != nil {
+				return edit{}, &bufferError{line: line, msg: err.Error()}
+			}
+			e.creates = append(e.creates, dst)
+			e.createLines = append(e.createLines, line)
+			continue
+		}
+		dst, err := unquote(dst)
+		if err != nil {
+			return edit{}, &bufferError{line: line, msg: err.Error()}
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil || n < 1 || n > len(srcs) {
+			return edit{}, &bufferError{line: line,
+				msg: fmt.Sprintf("unknown number %s", number)}
+		}
+		if !e.deleted[n-1] {
+			return edit{}, &bufferError{line: line,
+				msg: fmt.Sprintf("duplicate number %s", number)}
+		}
+
+		e.dsts[n-1] = dst
+		e.lines[n-1] = line
+		e.deleted[n-1] = false
+	}
+	if err := scanner.Err(); err != nil {
+		return edit{}, err
+	}
+
+	return e, nil
+}
+
+// annotate copies the buffer in r to w, with each of the messages in notes
+// written as a comment above the line it's keyed by, or at the top for those
+// keyed by 0, and without the comments that were there before.
+func annotate(r io.Reader, w io.Writer, notes map[int][]string) error {
+	scanner := bufio.NewScanner(r)
+	bw := bufio.NewWriter(w)
+
+	writeNotes := func(line int) {
+		for _, msg := range notes[line] {
+			bw.WriteString(annotationPrefix)
+			bw.WriteString(msg)
+			bw.WriteByte('\n')
+		}
+	}
+
+	writeNotes(0)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if strings.HasPrefix(text, annotationPrefix) {
+			continue
+		}
+
+		writeNotes(line)
+		bw.WriteString(text)
+		bw.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// errors are sticky, so this reports any from the writes above
+	return bw.Flush()
+}
+
+// parseNumbered splits a line of a numbered buffer into its number, which
+// must have exactly width digits, and the rest of the line, which must be
+// separated from it by a single space or tab
+func parseNumbered(line string, width int) (number, rest string, ok bool) {
+	i := 0
+	for i < len(line) && '0' <= line[i] && line[i] <= '9' {
+		i++
+	}
+	if i != width || i == len(line) || (line[i] != ' ' && line[i] != '\t') {
+		return "", "", false
+	}
+
+	return line[:i], line[i+1:], true
+}
+
+// quote returns name as it should be written to the buffer. Names that can't
+// be written as is, because they contain newlines, characters that wouldn't
+// be visible, or invalid UTF-8, are written as $'...' with backslash escapes,
+// like in bash. Names that start with $' or annotationPrefix are also quoted
+// so they're not mistaken for quoted names or annotations, as are those that
+// would be mistaken for numbered lines when width isn't 0, because they're
+// written without a number in a buffer whose numbers have width digits.
+func quote(name string, width int) string {
+	_, _, numbered := parseNumbered(name, width)
+	needsQuoting := strings.HasPrefix(name, "$'") ||
+		strings.HasPrefix(name, annotationPrefix) || (width != 0 && numbered)
+	for _, r := range name {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			needsQuoting = true
+			break
+		}
+	}
+	if !needsQuoting {
+		return name
+	}
+
+	var b strings.Builder
+	b.WriteString("$'")
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+
+		if c, found := escapes[r]; found && size == 1 {
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		} else if r == utf8.RuneError || !unicode.IsPrint(r) {
+			for _, c := range []byte(name[i : i+size]) {
+				fmt.Fprintf(&b, "\\x%02x", c)
+			}
+		} else {
+			b.WriteString(name[i : i+size])
+		}
+
+		i += size
+	}
+	b.WriteByte('\'')
+
+	return b.String()
+}
+
+// escapes maps characters to the letters used to escape them in quoted
+// names, other than \xHH, which works for any byte
+var escapes = map[rune]byte{
+	'\a': 'a', '\b': 'b', '\t': 't', '\n': 'n', '\v': 'v', '\f': 'f',
+	'\r': 'r', 0x1b: 'e', '\\': '\\', '\'': '\'',
+}
+
+// unquote reverses quote, returning line unchanged if it isn't quoted.
+func unquote(line string) (string, error) {
+	if !strings.HasPrefix(line, "$'") {
+		return line, nil
+	}
+
+	var b strings.Builder
+	for i := 2; i < len(line); i++ {
+		switch line[i] {
+		case '\'':
+			if i != len(line)-1 {
+				return "", errors.New("unexpected text after closing quote")
+			}
+			return b.String(), nil
+
+		case '\\':
+			i++
+			if i == len(line) {
+				break
+			}
+
+			if line[i] == 'x' {
+				if i+2 >= len(line) {
+					return "", errors.New("incomplete escape \\x")
+				}
+				c, err := strconv.ParseUint(line[i+1:i+3], 16, 8)
+				if err != nil {
+					return "", fmt.Errorf("invalid escape \\x%s", line[i+1:i+3])
+				}
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+
+			found := false
+			for r, c := range escapes {
+				if line[i] == c {
+					b.WriteRune(r)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return "", fmt.Errorf("invalid escape \\%c", line[i])
+			}
+
+		default:
+			b.WriteByte(line[i])
+		}
+	}
+
+	return "", errors.New("missing closing quote")
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_writeBuffer(t *testing.T) {
+	tests := []struct {
+		e        edit
+		numbered bool
+		expected string
+	}{
+		{
+			e:        edit{dsts: []string{"a", "b"}},
+			expected: "a\nb\n",
+		},
+		{
+			e:        edit{dsts: []string{"a", "b"}},
+			numbered: true,
+			expected: "0001 a\n0002 b\n",
+		},
+		{
+			e:        edit{dsts: make([]string, 10000)},
+			numbered: true,
+			expected: "00001 \n",
+		},
+		{
+			e: edit{
+				dsts:    []string{"a", "b", "c"},
+				deleted: []bool{false, true, false},
+				creates: []string{"d/", "e"},
+			},
+			numbered: true,
+			expected: "0001 a\n0003 c\nd/\ne\n",
+		},
+		{
+			e: edit{
+				dsts:    []string{"0002 a"},
+				creates: []string{"0001 b", "1 c"},
+			},
+			numbered: true,
+			expected: "0001 0002 a\n$'0001 b'\n1 c\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d %v", len(test.e.dsts), test.numbered), func(t *testing.T) {
+			var buf bytes.Buffer
+			requireNoError(t, writeBuffer(&buf, test.e, test.numbered))
+
+			if !strings.HasPrefix(buf.String(), test.expected) {
+				t.Fatalf("expected buffer to start with: %q, but it was: %q",
+					test.expected, buf.String())
+			}
+		})
+	}
+}
+
+func Test_readBuffer(t *testing.T) {
+	tests := []struct {
+		buffer          string
+		numbered        bool
+		expectedDsts    []string
+		expectedDeleted []bool
+		expectedCreates []string
+		// expectedLines are only checked if they're set
+		expectedLines []int
+		expectedErr   string
+	}{
+		{
+			buffer:          "c\nd\n",
+			expectedDsts:    []string{"c", "d"},
+			expectedDeleted: []bool{false, false},
+		},
+		{
+			buffer:          "# error: x\nc\n# error: y\nd\n",
+			expectedDsts:    []string{"c", "d"},
+			expectedDeleted: []bool{false, false},
+			expectedLines:   []int{2, 4},
+		},
+		{
+			buffer:      "c\n",
+			expectedErr: "tmpfile contains too few lines",
+		},
+		{
+			buffer:      "c\n# error: x\n$'\\q'\n",
+			expectedErr: "line 3: invalid escape \\q",
+		},
+		{
+			buffer:      "c\nd\ne\n",
+			expectedErr: "tmpfile contains too many lines",
+		},
+		{
+			buffer:          "0002\td\n\n0001 c\n",
+			numbered:        true,
+			expectedDsts:    []string{"c", "d"},
+			expectedDeleted: []bool{false, false},
+		},
+		{
+			buffer:          "0002 d\n",
+			numbered:        true,
+			expectedDsts:    []string{"a", "d"},
+			expectedDeleted: []bool{true, false},
+		},
+		{
+			buffer:          "0002  d \n",
+			numbered:        true,
+			expectedDsts:    []string{"a", " d "},
+			expectedDeleted: []bool{true, false},
+		},
+		{
+			buffer:          "0001 c\nd/\n0002\n1e\n",
+			numbered:        true,
+			expectedDsts:    []string{"c", "b"},
+			expectedDeleted: []bool{false, true},
+			expectedCreates: []string{"d/", "0002", "1e"},
+		},
+		{
+			buffer:          "# error: x\n0002 d\n# error: y\n$'# error: z'\n",
+			numbered:        true,
+			expectedDsts:    []string{"a", "d"},
+			expectedDeleted: []bool{true, false},
+			expectedCreates: []string{"# error: z"},
+			expectedLines:   []int{0, 2},
+		},
+		{
+			buffer:      "0003 c\n",
+			numbered:    true,
+			expectedErr: "line 1: unknown number 0003",
+		},
+		{
+			buffer:      "0000 c\n",
+			numbered:    true,
+			expectedErr: "line 1: unknown number 0000",
+		},
+		{
+			buffer:      "0002 c\n0002 d\n",
+			numbered:    true,
+			expectedErr: "line 2: duplicate number 0002",
+		},
+		{
+			// only numbers padded to the buffer's width are numbers
+			buffer:          "2 notes.txt\n01 intro.md\n00001 c\n",
+			numbered:        true,
+			expectedDsts:    []string{"a", "b"},
+			expectedDeleted: []bool{true, true},
+			expectedCreates: []string{"2 notes.txt", "01 intro.md", "00001 c"},
+		},
+		{
+			buffer:          "0001 a\n$'0002 b'\n",
+			numbered:        true,
+			expectedDsts:    []string{"a", "b"},
+			expectedDeleted: []bool{false, true},
+			expectedCreates: []string{"0002 b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%q %v", test.buffer, test.numbered), func(t *testing.T) {
+			e, err := readBuffer(strings.NewReader(test.buffer),
+				[]string{"a", "b"}, test.numbered)
+
+			if test.expectedErr != "" {
+				if err == nil || err.Error() != test.expectedErr {
+					t.Fatalf("expected error: %s did not match actual error: %v",
+						test.expectedErr, err)
+				}
+				return
+			}
+
+			requireNoError(t, err)
+			expected := fmt.Sprintf("%q %v %q", test.expectedDsts,
+				test.expectedDeleted, test.expectedCreates)
+			actual := fmt.Sprintf("%q %v %q", e.dsts, e.deleted, e.creates)
+			if expected != actual {
+				t.Fatalf("expected: %s did not match actual: %s",
+					expected, actual)
+			}
+			if test.expectedLines != nil &&
+				fmt.Sprint(test.expectedLines) != fmt.Sprint(e.lines) {
+				t.Fatalf("expected lines: %v did not match actual lines: %v",
+					test.expectedLines, e.lines)
+			}
+		})
+	}
+}
+
+func Test_annotate(t *testing.T) {
+	var b strings.Builder
+	err := annotate(strings.NewReader("# error: old\na\nb\n# error: old\nc\n"),
+		&b, map[int][]string{0: {"x"}, 3: {"y", "z"}})
+	requireNoError(t, err)
+
+	expected := "# error: x\na\n# error: y\n# error: z\nb\nc\n"
+	if b.String() != expected {
+		t.Fatalf("expected: %q did not match actual: %q", expected, b.String())
+	}
+}
+
+func Test_quote(t *testing.T) {
+	tests := []struct {
+		name     string
+		width    int
+		expected string
+	}{
+		{name: "a file", expected: "a file"},
+		{name: "ünïcödé 文件", expected: "ünïcödé 文件"},
+		{name: "a\nfile", expected: `$'a\nfile'`},
+		{name: "it's\t\\", expected: `$'it\'s\t\\'`},
+		{name: "\x1b[31m\x7f", expected: `$'\e[31m\x7f'`},
+		{name: "invalid\xff", expected: `$'invalid\xff'`},
+		{name: "zero​width", expected: `$'zero\xe2\x80\x8bwidth'`},
+		{name: "$'a'", expected: `$'$\'a\''`},
+		{name: "$a", expected: "$a"},
+		{name: "# error: a", expected: `$'# error: a'`},
+		{name: "# a", expected: "# a"},
+		{name: "0001 a", expected: "0001 a"},
+		{name: "0001 a", width: 4, expected: `$'0001 a'`},
+		{name: "0001\ta", width: 4, expected: `$'0001\ta'`},
+		{name: "01 a", width: 4, expected: "01 a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := quote(test.name, test.width)
+			if actual != test.expected {
+				t.Fatalf("expected quoted: %s did not match actual quoted: %s",
+					test.expected, actual)
+			}
+
+			unquoted, err := unquote(actual)
+			requireNoError(t, err)
+			if unquoted != test.name {
+				t.Fatalf("expected unquoted: %q did not match actual "+
+					"unquoted: %q", test.name, unquoted)
+			}
+		})
+	}
+}
+
+func Test_unquote_invalid(t *testing.T) {
+	tests := []struct {
+		line, expectedErr string
+	}{
+		{line: `$'a`, expectedErr: "missing closing quote"},
+		{line: `$'a\'`, expectedErr: "missing closing quote"},
+		{line: `$'a'b`, expectedErr: "unexpected text after closing quote"},
+		{line: `$'\q'`, expectedErr: `invalid escape \q`},
+		{line: `$'\xzz'`, expectedErr: `invalid escape \xzz`},
+		{line: `$'\x1'`, expectedErr: `invalid escape \x1'`},
+		{line: `$'\x1`, expectedErr: `incomplete escape \x`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			_, err := unquote(test.line)
+			if err == nil || err.Error() != test.expectedErr {
+				t.Fatalf("expected error: %s did not match actual error: %v",
+					test.expectedErr, err)
+			}
+		})
+	}
+}
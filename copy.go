@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// move moves src to dst like rename, except that if they're on different
+// filesystems, which rename can't handle, src is copied to dst and removed.
+func (d *dir) move(src, dst string) error {
+	err := d.rename(src, dst)
+	if !crossDevice(err) {
+		return err
+	}
+
+	return d.moveAcross(src, dst)
+}
+
+// moveAcross moves src to dst by copying it. The copy is made under a
+// temporary name next to dst from d.copyTmp, and verified before it's renamed
+// into place, so that dst never holds an incomplete copy, and src is only
+// removed once dst is complete and d.copied has been told. If anything goes
+// wrong before then, the copy is removed, which leaves things as they were.
+func (d *dir) moveAcross(src, dst string) error {
+	var tmp string
+	var created bool
+	var err error
+	for {
+		tmp, err = d.copyTmp(dst)
+		if err != nil {
+			return fmt.Errorf("copying %q to %q failed: %w", src, dst, err)
+		}
+		// the copy is only ever created where nothing exists, which reserves
+		// its name, so if something took the name after it was chosen, we
+		// move on to the next one
+		created, err = d.copyTree(src, tmp)
+		if created || !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err == nil {
+		err = d.compareTrees(src, tmp)
+	}
+	if err == nil {
+		err = d.rename(tmp, dst)
+	}
+	if err != nil {
+		if created {
+			_ = d.removeAll(tmp)
+		}
+		return fmt.Errorf("copying %q to %q failed: %w", src, dst, err)
+	}
+	if d.copied != nil {
+		err = d.copied(src)
+		if err != nil {
+			// src hasn't been touched, so removing the copy leaves things as
+			// they were
+			_ = d.removeAll(dst)
+			return fmt.Errorf("copying %q to %q failed: %w", src, dst, err)
+		}
+	}
+
+	err = d.removeAll(src)
+	if err != nil {
+		return fmt.Errorf("%q was copied to %q, but removing it failed: %w",
+			src, dst, err)
+	}
+
+	return nil
+}
+
+// copyTree copies src to dst, which mustn't exist, along with everything
+// beneath it if it's a directory. Symlinks are copied as symlinks, and
+// metadata is copied as far as copyMetadata can. created reports whether dst
+// was created, even if copying failed after that.
+func (d *dir) copyTree(src, dst string) (created bool, err error) {
+	info, err := d.lstat(src)
+	if err != nil {
+		return false, err
+	}
+
+	switch info.Mode().Type() {
+	case 0:
+		in, err := d.open(src)
+		if err != nil {
+			return false, err
+		}
+		defer in.Close()
+
+		out, err := d.openNew(dst, 0o600)
+		if err != nil {
+			return false, err
+		}
+		_, err = io.Copy(out, in)
+		if err == nil {
+			// the copy has to be durable before src is removed
+			err = out.Sync()
+		}
+		closeErr := out.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return true, err
+		}
+
+	case fs.ModeDir:
+		err = d.create(dst, true)
+		if err != nil {
+			return false, err
+		}
+
+		entries, err := d.readDir(src)
+		if err != nil {
+			return true, err
+		}
+		for _, entry := range entries {
+			_, err = d.copyTree(path.Join(src, entry.Name()),
+				path.Join(dst, entry.Name()))
+			if err != nil {
+				return true, err
+			}
+		}
+
+	case fs.ModeSymlink:
+		target, err := d.readlink(src)
+		if err != nil {
+			return false, err
+		}
+		err = d.symlink(target, dst)
+		if err != nil {
+			return false, err
+		}
+
+	default:
+		return false, fmt.Errorf("%q can't be copied because of its type", src)
+	}
+
+	// this comes last so that copying the contents of directories doesn't
+	// change their timestamps
+	return true, d.copyMetadata(src, dst, info)
+}
+
+// compareTrees checks that b is a copy of a, by comparing their types,
+// modes, contents, and the targets of symlinks.
+func (d *dir) compareTrees(a, b string) error {
+	aInfo, err := d.lstat(a)
+	if err != nil {
+		return err
+	}
+	bInfo, err := d.lstat(b)
+	if err != nil {
+		return err
+	}
+
+	differs := fmt.Errorf("%q differs from its copy", a)
+	if aInfo.Mode().Type() != bInfo.Mode().Type() {
+		return differs
+	}
+
+	switch aInfo.Mode().Type() {
+	case 0:
+		if aInfo.Mode() != bInfo.Mode() || aInfo.Size() != bInfo.Size() {
+			return differs
+		}
+
+		same, err := d.sameContents(a, b)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return differs
+		}
+
+	case fs.ModeDir:
+		if aInfo.Mode() != bInfo.Mode() {
+			return differs
+		}
+
+		aEntries, err := d.readDir(a)
+		if err != nil {
+			return err
+		}
+		bEntries, err := d.readDir(b)
+		if err != nil {
+			return err
+		}
+		if len(aEntries) != len(bEntries) {
+			return differs
+		}
+		for i, entry := range aEntries {
+			if entry.Name() != bEntries[i].Name() {
+				return differs
+			}
+
+			err = d.compareTrees(path.Join(a, entry.Name()),
+				path.Join(b, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+
+	case fs.ModeSymlink:
+		aTarget, err := d.readlink(a)
+		if err != nil {
+			return err
+		}
+		bTarget, err := d.readlink(b)
+		if err != nil {
+			return err
+		}
+		if aTarget != bTarget {
+			return differs
+		}
+	}
+
+	return nil
+}
+
+// sameContents reports whether the regular files a and b have the same
+// contents.
+func (d *dir) sameContents(a, b string) (bool, error) {
+	aFile, err := d.open(a)
+	if err != nil {
+		return false, err
+	}
+	defer aFile.Close()
+	bFile, err := d.open(b)
+	if err != nil {
+		return false, err
+	}
+	defer bFile.Close()
+
+	aBuf, bBuf := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		aN, aErr := io.ReadFull(aFile, aBuf)
+		bN, bErr := io.ReadFull(bFile, bBuf)
+		if !bytes.Equal(aBuf[:aN], bBuf[:bN]) {
+			return false, nil
+		}
+
+		// either both files ended, or one of them is shorter
+		if aErr == io.EOF || aErr == io.ErrUnexpectedEOF {
+			return aErr == bErr, nil
+		}
+		if aErr != nil {
+			return false, aErr
+		}
+		if bErr != nil {
+			return false, bErr
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_dir_moveAcross(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	mtime := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	requireNoError(t, os.MkdirAll(filepath.Join(tempDir, "a", "b"), 0o755))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a", "b", "c"), []byte("c"), 0o640))
+	requireNoError(t, os.Symlink("b/c", filepath.Join(tempDir, "a", "d")))
+	requireNoError(t, os.Chtimes(filepath.Join(tempDir, "a", "b", "c"), mtime, mtime))
+	requireNoError(t, os.Chmod(filepath.Join(tempDir, "a", "b"), 0o750))
+	requireNoError(t, os.Chtimes(filepath.Join(tempDir, "a", "b"), mtime, mtime))
+
+	tn := &tmpNamer{pattern: defaultTmpPattern, session: "s",
+		taken: takenIn[string, string](nil, nil, d)}
+	d.copyTmp = tn.name
+	var copied []string
+	d.copied = func(src string) error {
+		// the copy is in place, and src hasn't been removed yet
+		for _, name := range []string{"a", "e"} {
+			_, err := os.Lstat(filepath.Join(tempDir, name))
+			requireNoError(t, err)
+		}
+		copied = append(copied, src)
+		return nil
+	}
+	requireNoError(t, d.moveAcross("a", "e"))
+	if len(copied) != 1 || copied[0] != "a" {
+		t.Fatalf("expected copied to be called with: %q but it was called "+
+			"with: %q", []string{"a"}, copied)
+	}
+
+	_, err := os.Lstat(filepath.Join(tempDir, "a"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a to have been removed, but the error was: %v", err)
+	}
+	_, err = os.Lstat(filepath.Join(tempDir, ".vimv2-s-1"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the copy to have been renamed, but the error "+
+			"was: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(tempDir, "e", "b", "c"))
+	requireNoError(t, err)
+	if string(b) != "c" {
+		t.Fatalf("expected e/b/c to contain: %q but it contained: %q", "c", b)
+	}
+	for name, expectedMode := range map[string]fs.FileMode{
+		"e/b":   fs.ModeDir | 0o750,
+		"e/b/c": 0o640,
+	} {
+		info, err := os.Lstat(filepath.Join(tempDir, name))
+		requireNoError(t, err)
+		if info.Mode() != expectedMode {
+			t.Fatalf("expected %s to have mode: %v but it had mode: %v",
+				name, expectedMode, info.Mode())
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Fatalf("expected %s to have been modified at: %v but it was "+
+				"modified at: %v", name, mtime, info.ModTime())
+		}
+	}
+	target, err := os.Readlink(filepath.Join(tempDir, "e", "d"))
+	requireNoError(t, err)
+	if target != "b/c" {
+		t.Fatalf("expected e/d to link to: %q but it linked to: %q", "b/c",
+			target)
+	}
+}
+
+func Test_dir_moveAcross_exists(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a"), []byte("a"), 0o644))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "b"), []byte("b"), 0o644))
+
+	tn := &tmpNamer{pattern: defaultTmpPattern, session: "s",
+		taken: takenIn[string, string](nil, nil, d)}
+	d.copyTmp = tn.name
+	err := d.moveAcross("a", "b")
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected moving a to b to fail because it exists, but the "+
+			"error was: %v", err)
+	}
+
+	// the copy is removed, and a is left alone
+	for name, expected := range map[string]string{"a": "a", "b": "b"} {
+		b, err := os.ReadFile(filepath.Join(tempDir, name))
+		requireNoError(t, err)
+		if string(b) != expected {
+			t.Fatalf("expected %s to contain: %q but it contained: %q",
+				name, expected, b)
+		}
+	}
+	_, err = os.Lstat(filepath.Join(tempDir, ".vimv2-s-1"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the copy to have been removed, but the error "+
+			"was: %v", err)
+	}
+}
+
+func Test_dir_moveAcross_tmpTaken(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a"), []byte("a"), 0o644))
+	// this appears after the name is chosen, but before it's used
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, ".vimv2-s-1"), []byte("x"), 0o644))
+
+	tn := &tmpNamer{pattern: defaultTmpPattern, session: "s",
+		taken: takenIn[string, string](nil, nil, nil)}
+	d.copyTmp = tn.name
+	requireNoError(t, d.moveAcross("a", "b"))
+
+	for name, expected := range map[string]string{".vimv2-s-1": "x", "b": "a"} {
+		b, err := os.ReadFile(filepath.Join(tempDir, name))
+		requireNoError(t, err)
+		if string(b) != expected {
+			t.Fatalf("expected %s to contain: %q but it contained: %q",
+				name, expected, b)
+		}
+	}
+}
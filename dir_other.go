@@ -0,0 +1,176 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// dir is a handle to the directory in which we're renaming things. All paths
+// passed to its methods are interpreted relative to that directory. On this
+// platform we can't hold on to the directory itself, so paths are joined with
+// the one the directory was opened with.
+type dir struct {
+	path string
+	// copyTmp provides the temporary names that copies are made under when
+	// things are moved across filesystems
+	copyTmp tmpFunc
+	// copied, if set, is called with what was copied once its copy has been
+	// renamed into place, before it's removed
+	copied func(src string) error
+}
+
+func openDir(path string) (*dir, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dir{path: path}, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+// readDir returns the entries of the directory name, sorted by filename.
+func (d *dir) readDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(d.join(name))
+}
+
+// lstat returns information about name without following symlinks.
+func (d *dir) lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(d.join(name))
+}
+
+// rename moves src to dst. It fails if dst already exists, though since that
+// has to be checked beforehand, something could still appear there in
+// between.
+func (d *dir) rename(src, dst string) error {
+	_, err := os.Lstat(d.join(dst))
+	if err == nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return os.Rename(d.join(src), d.join(dst))
+}
+
+// create creates name as an empty file, or as a directory if dir is set. It
+// fails if name already exists.
+func (d *dir) create(name string, dir bool) error {
+	if dir {
+		return os.Mkdir(d.join(name), 0o777)
+	}
+
+	f, err := d.openNew(name, 0o666)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// open opens name for reading.
+func (d *dir) open(name string) (*os.File, error) {
+	return os.Open(d.join(name))
+}
+
+// openNew creates name with the given permissions and opens it for writing.
+// It fails if name already exists.
+func (d *dir) openNew(name string, perm fs.FileMode) (*os.File, error) {
+	return os.OpenFile(d.join(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+}
+
+// readlink returns the target of the symlink name.
+func (d *dir) readlink(name string) (string, error) {
+	return os.Readlink(d.join(name))
+}
+
+// symlink creates name as a symlink to target.
+func (d *dir) symlink(target, name string) error {
+	return os.Symlink(target, d.join(name))
+}
+
+// copyMetadata gives dst the mode and modification time of src, which info
+// describes, which is all that can be copied on this platform.
+func (d *dir) copyMetadata(src, dst string, info fs.FileInfo) error {
+	if info.Mode().Type() == fs.ModeSymlink {
+		return nil
+	}
+
+	err := os.Chmod(d.join(dst), info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(d.join(dst), info.ModTime(), info.ModTime())
+}
+
+// crossDevice reports whether err is because a rename was across
+// filesystems.
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// changeTime returns the time that the file info describes last had its
+// status changed, which isn't available on this platform, so the
+// modification time is used instead.
+func changeTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// writable reports whether we're allowed to create and remove things within
+// the directory name, which can't be checked on this platform, so it's
+// assumed that we are.
+func (d *dir) writable(name string) (bool, error) {
+	return true, nil
+}
+
+// remove removes name, which must be an empty directory if dir is set, and
+// mustn't be a directory otherwise.
+func (d *dir) remove(name string, dir bool) error {
+	info, err := os.Lstat(d.join(name))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() != dir {
+		return &os.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return os.Remove(d.join(name))
+}
+
+// removeAll removes name, and everything beneath it if it's a directory.
+func (d *dir) removeAll(name string) error {
+	return os.RemoveAll(d.join(name))
+}
+
+// atomicExchange indicates that dir.exchange is atomic, which it isn't on this
+// platform
+const atomicExchange = false
+
+// exchange swaps a and b by moving a out of the way to tmp.
+func (d *dir) exchange(a, b, tmp string) error {
+	return exchangeVia(d.move, a, b, tmp)
+}
+
+func (d *dir) join(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(d.path, name)
+}
+
+// fileID returns the device and inode numbers of the file described by info,
+// which aren't available on this platform.
+func fileID(info fs.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_dir_rename(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a"), []byte("a"), 0o644))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "b"), []byte("b"), 0o644))
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "c"), 0o755))
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "d"), 0o755))
+
+	for _, test := range [][2]string{{"a", "b"}, {"c", "d"}} {
+		err := d.rename(test[0], test[1])
+		if !errors.Is(err, fs.ErrExist) {
+			t.Fatalf("expected renaming %s to %s to fail because it exists, "+
+				"but the error was: %v", test[0], test[1], err)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(tempDir, "b"))
+	requireNoError(t, err)
+	if string(b) != "b" {
+		t.Fatalf("b was overwritten with: %q", b)
+	}
+
+	requireNoError(t, d.rename("a", "e"))
+	b, err = os.ReadFile(filepath.Join(tempDir, "e"))
+	requireNoError(t, err)
+	if string(b) != "a" {
+		t.Fatalf("expected e to contain: %q but it contained: %q", "a", b)
+	}
+}
+
+func Test_dir_exchange(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a"), []byte("a"), 0o644))
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "b"), 0o755))
+
+	requireNoError(t, d.exchange("a", "b", "a.tmp1"))
+
+	info, err := os.Lstat(filepath.Join(tempDir, "a"))
+	requireNoError(t, err)
+	if !info.IsDir() {
+		t.Fatal("expected a to be a directory after exchanging")
+	}
+	b, err := os.ReadFile(filepath.Join(tempDir, "b"))
+	requireNoError(t, err)
+	if string(b) != "a" {
+		t.Fatalf("expected b to contain: %q but it contained: %q", "a", b)
+	}
+	_, err = os.Lstat(filepath.Join(tempDir, "a.tmp1"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a.tmp1 not to exist, but the error was: %v", err)
+	}
+}
@@ -0,0 +1,365 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// dir is a handle to the directory in which we're renaming things. All paths
+// passed to its methods are interpreted relative to the directory that was
+// opened, even if that directory is renamed or replaced while we're running.
+type dir struct {
+	fd   int
+	path string
+	// copyTmp provides the temporary names that copies are made under when
+	// things are moved across filesystems
+	copyTmp tmpFunc
+	// copied, if set, is called with what was copied once its copy has been
+	// renamed into place, before it's removed
+	copied func(src string) error
+}
+
+func openDir(path string) (*dir, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return &dir{fd: fd, path: path}, nil
+}
+
+func (d *dir) Close() error {
+	err := unix.Close(d.fd)
+	if err != nil {
+		return &os.PathError{Op: "close", Path: d.path, Err: err}
+	}
+
+	return nil
+}
+
+// readDir returns the entries of the directory name, sorted by filename.
+func (d *dir) readDir(name string) ([]fs.DirEntry, error) {
+	// we open the directory again instead of duplicating d.fd, because
+	// duplicated descriptors share their offset, so we'd only be able to read
+	// the entries once
+	fd, err := unix.Openat(d.fd, name,
+		unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: name, Err: err}
+	}
+
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, err
+}
+
+// lstat returns information about name without following symlinks. The Sys
+// method of the result returns a *unix.Stat_t.
+func (d *dir) lstat(name string) (fs.FileInfo, error) {
+	info := &statInfo{name: path.Base(name)}
+	err := unix.Fstatat(d.fd, name, &info.st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, &os.PathError{Op: "fstatat", Path: name, Err: err}
+	}
+
+	return info, nil
+}
+
+// rename moves src to dst. It fails if dst already exists, so that nothing is
+// ever clobbered.
+func (d *dir) rename(src, dst string) error {
+	err := renameNoReplace(d.fd, src, dst)
+	if err != nil {
+		return &os.LinkError{Op: "renameat", Old: src, New: dst, Err: err}
+	}
+
+	return nil
+}
+
+// renameLinking renames src to dst within the directory fd by hard linking
+// dst to src, then unlinking src, which fails if dst exists just like
+// RENAME_NOREPLACE. Directories can't be linked, and not all filesystems
+// support links, so in those cases, dst is reserved before renaming instead.
+func renameLinking(fd int, src, dst string) error {
+	err := unix.Linkat(fd, src, fd, dst, 0)
+	switch err {
+	case nil:
+	case unix.EPERM, unix.EOPNOTSUPP, unix.EMLINK:
+		return renameReserving(fd, src, dst)
+	default:
+		return err
+	}
+
+	err = unix.Unlinkat(fd, src, 0)
+	if err != nil {
+		// put things back the way they were
+		_ = unix.Unlinkat(fd, dst, 0)
+		return err
+	}
+
+	return nil
+}
+
+// renameReserving renames src to dst within the directory fd after reserving
+// dst, by creating an empty directory there if src is a directory, or an
+// empty file otherwise, either of which fails if anything's already at dst.
+// Renaming then replaces what was reserved, so nothing that appears at dst in
+// the meantime can be clobbered. It's only used when nothing better is
+// supported.
+func renameReserving(fd int, src, dst string) error {
+	var st unix.Stat_t
+	err := unix.Fstatat(fd, src, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return err
+	}
+
+	isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+	if isDir {
+		err = unix.Mkdirat(fd, dst, 0o700)
+	} else {
+		var reserved int
+		reserved, err = unix.Openat(fd, dst,
+			unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC,
+			0o600)
+		if err == nil {
+			err = unix.Close(reserved)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = unix.Renameat(fd, src, fd, dst)
+	if err != nil {
+		// give up the reservation, which can't have anything in it if it's a
+		// directory, since removing it would fail
+		flags := 0
+		if isDir {
+			flags = unix.AT_REMOVEDIR
+		}
+		_ = unix.Unlinkat(fd, dst, flags)
+		return err
+	}
+
+	return nil
+}
+
+// create creates name as an empty file, or as a directory if dir is set. It
+// fails if name already exists.
+func (d *dir) create(name string, dir bool) error {
+	if dir {
+		err := unix.Mkdirat(d.fd, name, 0o777)
+		if err != nil {
+			return &os.PathError{Op: "mkdirat", Path: name, Err: err}
+		}
+
+		return nil
+	}
+
+	f, err := d.openNew(name, 0o666)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// open opens name for reading. It fails if name is a symlink.
+func (d *dir) open(name string) (*os.File, error) {
+	fd, err := unix.Openat(d.fd, name,
+		unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: name, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// openNew creates name with the given permissions and opens it for writing.
+// It fails if name already exists.
+func (d *dir) openNew(name string, perm fs.FileMode) (*os.File, error) {
+	fd, err := unix.Openat(d.fd, name,
+		unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_CLOEXEC, uint32(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: name, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// copyMetadata gives dst the ownership, mode, extended attributes and
+// timestamps of src, which info describes. Ownership is only copied if we're
+// allowed to change it, and symlinks only get their ownership and timestamps
+// copied, since that's all they have.
+func (d *dir) copyMetadata(src, dst string, info fs.FileInfo) error {
+	st := info.Sys().(*unix.Stat_t)
+
+	err := unix.Fchownat(d.fd, dst, int(st.Uid), int(st.Gid),
+		unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil && err != unix.EPERM {
+		return &os.PathError{Op: "fchownat", Path: dst, Err: err}
+	}
+
+	if info.Mode().Type() != fs.ModeSymlink {
+		// this has to happen while dst is still readable
+		err = d.copyXattrs(src, dst)
+		if err != nil {
+			return err
+		}
+
+		// changing ownership clears the setuid and setgid bits, so this has
+		// to come after that
+		err = unix.Fchmodat(d.fd, dst, uint32(st.Mode)&0o7777, 0)
+		if err != nil {
+			return &os.PathError{Op: "fchmodat", Path: dst, Err: err}
+		}
+	}
+
+	err = unix.UtimesNanoAt(d.fd, dst, []unix.Timespec{st.Atim, st.Mtim},
+		unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return &os.PathError{Op: "utimensat", Path: dst, Err: err}
+	}
+
+	return nil
+}
+
+// crossDevice reports whether err is because a rename was across
+// filesystems.
+func crossDevice(err error) bool {
+	return errors.Is(err, unix.EXDEV)
+}
+
+// changeTime returns the time that the file info describes last had its
+// status changed.
+func changeTime(info fs.FileInfo) time.Time {
+	st := info.Sys().(*unix.Stat_t)
+	return time.Unix(st.Ctim.Unix())
+}
+
+// writable reports whether we're allowed to create and remove things within
+// the directory name.
+func (d *dir) writable(name string) (bool, error) {
+	err := unix.Faccessat(d.fd, name, unix.W_OK|unix.X_OK, 0)
+	if err == unix.EACCES || err == unix.EROFS {
+		return false, nil
+	} else if err != nil {
+		return false, &os.PathError{Op: "faccessat", Path: name, Err: err}
+	}
+
+	return true, nil
+}
+
+// remove removes name, which must be an empty directory if dir is set, and
+// mustn't be a directory otherwise.
+func (d *dir) remove(name string, dir bool) error {
+	flags := 0
+	if dir {
+		flags = unix.AT_REMOVEDIR
+	}
+
+	err := unix.Unlinkat(d.fd, name, flags)
+	if err != nil {
+		return &os.PathError{Op: "unlinkat", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// removeAll removes name, and everything beneath it if it's a directory.
+func (d *dir) removeAll(name string) error {
+	var st unix.Stat_t
+	err := unix.Fstatat(d.fd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return &os.PathError{Op: "fstatat", Path: name, Err: err}
+	}
+
+	flags := 0
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		entries, err := d.readDir(name)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			err := d.removeAll(path.Join(name, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+
+		flags = unix.AT_REMOVEDIR
+	}
+
+	err = unix.Unlinkat(d.fd, name, flags)
+	if err != nil {
+		return &os.PathError{Op: "unlinkat", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// statInfo implements fs.FileInfo for the results of fstatat
+type statInfo struct {
+	name string
+	st   unix.Stat_t
+}
+
+func (i *statInfo) Name() string       { return i.name }
+func (i *statInfo) Size() int64        { return i.st.Size }
+func (i *statInfo) ModTime() time.Time { return time.Unix(i.st.Mtim.Unix()) }
+func (i *statInfo) IsDir() bool        { return i.Mode().IsDir() }
+func (i *statInfo) Sys() any           { return &i.st }
+
+func (i *statInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(i.st.Mode & 0o777)
+	switch i.st.Mode & unix.S_IFMT {
+	case unix.S_IFBLK:
+		mode |= fs.ModeDevice
+	case unix.S_IFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case unix.S_IFDIR:
+		mode |= fs.ModeDir
+	case unix.S_IFIFO:
+		mode |= fs.ModeNamedPipe
+	case unix.S_IFLNK:
+		mode |= fs.ModeSymlink
+	case unix.S_IFSOCK:
+		mode |= fs.ModeSocket
+	}
+	if i.st.Mode&unix.S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if i.st.Mode&unix.S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if i.st.Mode&unix.S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+
+	return mode
+}
+
+// fileID returns the device and inode numbers of the file described by info,
+// which must have come from lstat.
+func fileID(info fs.FileInfo) (dev, ino uint64, ok bool) {
+	st, ok := info.Sys().(*unix.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return uint64(st.Dev), uint64(st.Ino), true
+}
@@ -0,0 +1,86 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_renameLinking(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a"), nil, 0o644))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "b"), nil, 0o644))
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "c"), 0o755))
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "d"), 0o755))
+
+	err := renameLinking(d.fd, "a", "b")
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected renaming a file to an existing name to fail, but "+
+			"the error was: %v", err)
+	}
+	// directories are reserved instead, since they can't be linked
+	err = renameLinking(d.fd, "c", "d")
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected renaming a directory to an existing name to fail, "+
+			"but the error was: %v", err)
+	}
+
+	requireNoError(t, renameLinking(d.fd, "a", "e"))
+	requireNoError(t, renameLinking(d.fd, "c", "f"))
+
+	entries, err := os.ReadDir(tempDir)
+	requireNoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 4 || names[0] != "b" || names[1] != "d" ||
+		names[2] != "e" || names[3] != "f" {
+		t.Fatalf("expected entries: [b d e f] did not match actual entries: %v",
+			names)
+	}
+}
+
+func Test_renameReserving(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a"), []byte("a"), 0o644))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "b"), []byte("b"), 0o644))
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "c"), 0o755))
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "d"), 0o755))
+
+	for _, m := range [][2]string{{"a", "b"}, {"a", "d"}, {"c", "b"}, {"c", "d"}} {
+		err := renameReserving(d.fd, m[0], m[1])
+		if !errors.Is(err, fs.ErrExist) {
+			t.Fatalf("expected renaming %s to %s to fail because it exists, "+
+				"but the error was: %v", m[0], m[1], err)
+		}
+	}
+
+	requireNoError(t, renameReserving(d.fd, "a", "e"))
+	requireNoError(t, renameReserving(d.fd, "c", "f"))
+
+	b, err := os.ReadFile(filepath.Join(tempDir, "e"))
+	requireNoError(t, err)
+	if string(b) != "a" {
+		t.Fatalf("expected e to contain: %q but it contained: %q", "a", b)
+	}
+	info, err := os.Lstat(filepath.Join(tempDir, "f"))
+	requireNoError(t, err)
+	if !info.IsDir() {
+		t.Fatalf("expected f to be a directory, but its mode was: %v",
+			info.Mode())
+	}
+	for _, name := range []string{"a", "c"} {
+		_, err = os.Lstat(filepath.Join(tempDir, name))
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("expected %s to have been renamed, but the error was: %v",
+				name, err)
+		}
+	}
+}
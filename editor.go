@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// editorCommand returns a command that runs editor on file. editor is split
+// into words the way a POSIX shell would, but if it uses any other shell
+// features, like variables or pipes, it's run by sh instead.
+func editorCommand(editor, file string) (*exec.Cmd, error) {
+	words, needsShell, err := splitWords(editor)
+	if err != nil {
+		return nil, err
+	}
+
+	if needsShell {
+		return exec.Command("sh", "-c", editor+` "$@"`, "sh", file), nil
+	}
+	if len(words) == 0 {
+		return nil, errors.New("editor command is empty")
+	}
+
+	return exec.Command(words[0], append(words[1:], file)...), nil
+}
+
+// filterCommand returns a command that runs filter, which is interpreted the
+// same way as the editor is by editorCommand, but without any arguments.
+func filterCommand(filter string) (*exec.Cmd, error) {
+	words, needsShell, err := splitWords(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if needsShell {
+		return exec.Command("sh", "-c", filter), nil
+	}
+	if len(words) == 0 {
+		return nil, errors.New("filter command is empty")
+	}
+
+	return exec.Command(words[0], words[1:]...), nil
+}
+
+// splitWords splits s into words, handling quotes and backslash escapes like
+// a POSIX shell. If s contains anything else a shell would interpret, such as
+// expansions, redirections or control operators, needsShell is set and words
+// should be ignored.
+func splitWords(s string) (words []string, needsShell bool, err error) {
+	var word strings.Builder
+	// inWord is set when a word has been started, even if it's still empty,
+	// like after ""
+	inWord := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch c {
+		case ' ', '\t', '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case '\\':
+			i++
+			if i == len(s) {
+				return nil, false, errors.New("trailing backslash")
+			}
+			// an escaped newline is a line continuation
+			if s[i] != '\n' {
+				word.WriteByte(s[i])
+				inWord = true
+			}
+
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return nil, false, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+
+		case '"':
+			inWord = true
+			for i++; ; i++ {
+				if i == len(s) {
+					return nil, false, errors.New("unterminated double quote")
+				}
+				if s[i] == '"' {
+					break
+				}
+
+				switch s[i] {
+				case '$', '`':
+					return nil, true, nil
+				case '\\':
+					// within double quotes, backslashes only escape these
+					if i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) != -1 {
+						i++
+						if s[i] == '\n' {
+							continue
+						}
+					}
+				}
+				word.WriteByte(s[i])
+			}
+
+		case '|', '&', ';', '<', '>', '(', ')', '$', '`', '*', '?', '[':
+			return nil, true, nil
+
+		case '#', '~':
+			// these are only special at the start of a word
+			if !inWord {
+				return nil, true, nil
+			}
+			word.WriteByte(c)
+
+		case '=':
+			// variable assignments before the command
+			if len(words) == 0 {
+				return nil, true, nil
+			}
+			word.WriteByte(c)
+			inWord = true
+
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, false, nil
+}
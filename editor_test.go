@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_splitWords(t *testing.T) {
+	tests := []struct {
+		s                  string
+		expectedWords      []string
+		expectedNeedsShell bool
+		expectedErr        string
+	}{
+		{s: "vim", expectedWords: []string{"vim"}},
+		{s: "  code   --wait ", expectedWords: []string{"code", "--wait"}},
+		{s: `nvim -u NONE`, expectedWords: []string{"nvim", "-u", "NONE"}},
+		{s: `'/my editor/vi' a''b ""`, expectedWords: []string{"/my editor/vi", "ab", ""}},
+		{s: `"a \"b\" \c \\ \$"`, expectedWords: []string{`a "b" \c \ $`}},
+		{s: `a\ b\'c \
+d`, expectedWords: []string{"a b'c", "d"}},
+		{s: `emacs -nw a#b~c=d`, expectedWords: []string{"emacs", "-nw", "a#b~c=d"}},
+		{s: `vim $FLAGS`, expectedNeedsShell: true},
+		{s: `vim "$FLAGS"`, expectedNeedsShell: true},
+		{s: "vim `flags`", expectedNeedsShell: true},
+		{s: `vim; true`, expectedNeedsShell: true},
+		{s: `vim # comment`, expectedNeedsShell: true},
+		{s: `~/bin/vim`, expectedNeedsShell: true},
+		{s: `TERM=xterm vim`, expectedNeedsShell: true},
+		{s: `vim *`, expectedNeedsShell: true},
+		{s: `vim '`, expectedErr: "unterminated single quote"},
+		{s: `vim "`, expectedErr: "unterminated double quote"},
+		{s: `vim \`, expectedErr: "trailing backslash"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			words, needsShell, err := splitWords(test.s)
+
+			if test.expectedErr != "" {
+				if err == nil || err.Error() != test.expectedErr {
+					t.Fatalf("expected error: %s did not match actual error: %v",
+						test.expectedErr, err)
+				}
+				return
+			}
+
+			requireNoError(t, err)
+			if needsShell != test.expectedNeedsShell {
+				t.Fatalf("expected needsShell: %v did not match actual "+
+					"needsShell: %v", test.expectedNeedsShell, needsShell)
+			}
+			if !needsShell && fmt.Sprintf("%q", words) !=
+				fmt.Sprintf("%q", test.expectedWords) {
+				t.Fatalf("expected words: %q did not match actual words: %q",
+					test.expectedWords, words)
+			}
+		})
+	}
+}
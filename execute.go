@@ -0,0 +1,195 @@
+package main
+
+import "fmt"
+
+// an executor performs ops using the functions it contains
+type executor struct {
+	move     moveFunc
+	exchange exchangeFunc
+	create   createFunc
+	// remove is used to remove things when they're deleted
+	remove removeFunc
+	// trash is used to move things to the trash when they're trashed, and
+	// restore moves them back from where trash put them
+	trash   trashFunc
+	restore func(trashed, src string) error
+	// trashed holds where the things each trash op moved to the trash ended
+	// up, once it's been performed. It's filled in as ops are performed if
+	// it's nil.
+	trashed []string
+	// uncreate is used to remove things that were created, which are
+	// expected to be empty by the time they're removed
+	uncreate createFunc
+	// log, if set, is called with an event for each op once it's been
+	// performed or undone, or has failed, and before each exchange is
+	// performed or undone
+	log func(e journalEvent) error
+}
+
+// a rollbackFailure is an op that couldn't be reversed while rolling back
+type rollbackFailure struct {
+	op  op
+	err error
+}
+
+// a rollbackError indicates that an op failed after others had already been
+// performed, so they were rolled back
+type rollbackError struct {
+	// err is the error that caused the rollback
+	err      error
+	failures []rollbackFailure
+}
+
+func (e *rollbackError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rollbackError) Unwrap() error {
+	return e.err
+}
+
+// execute performs ops in order, starting from ops[start], since the ones
+// before it have already been performed. If one fails, those that were
+// already performed are reversed in the opposite order, and a *rollbackError
+// is returned, which reports any that couldn't be reversed. Deletions can't
+// be reversed.
+func execute(ops []op, start int, x executor) error {
+	if x.trashed == nil {
+		x.trashed = make([]string, len(ops))
+	}
+
+	for i := start; i < len(ops); i++ {
+		err := x.prepare(ops, i)
+		if err == nil {
+			err = x.do(ops, i)
+		}
+		if err == nil {
+			err = x.logEvent(eventDone, i)
+			if err == nil {
+				continue
+			}
+			// the op was performed even though logging it failed, so it has
+			// to be rolled back too
+			i++
+		} else {
+			// there's nothing to do if this fails, since the undone events
+			// also indicate that we're rolling back
+			_ = x.logEvent(eventFailed, i)
+		}
+		if i == 0 {
+			// nothing's changed, so there's nothing to roll back
+			return err
+		}
+
+		performed := make([]bool, len(ops))
+		for j := 0; j < i; j++ {
+			performed[j] = true
+		}
+		return &rollbackError{err: err, failures: rollback(ops, performed, x)}
+	}
+
+	return nil
+}
+
+// rollback reverses the ops that have been performed, in the opposite order,
+// and returns those that couldn't be reversed. performed is updated as ops
+// are reversed.
+func rollback(ops []op, performed []bool, x executor) []rollbackFailure {
+	var failures []rollbackFailure
+	for i := len(ops) - 1; i >= 0; i-- {
+		if !performed[i] {
+			continue
+		}
+
+		err := x.prepare(ops, i)
+		if err != nil {
+			err = fmt.Errorf("journaling failed: %w", err)
+		} else {
+			err = x.undo(ops, i)
+		}
+		if err == nil {
+			performed[i] = false
+			err = x.logEvent(eventUndone, i)
+			if err != nil {
+				err = fmt.Errorf("journaling failed: %w", err)
+			}
+		}
+		if err != nil {
+			failures = append(failures, rollbackFailure{op: ops[i], err: err})
+		}
+	}
+
+	return failures
+}
+
+func (x executor) logEvent(kind eventKind, i int) error {
+	if x.log == nil {
+		return nil
+	}
+
+	e := journalEvent{Kind: kind, Op: i}
+	if kind == eventDone && i < len(x.trashed) {
+		e.Trashed = x.trashed[i]
+	}
+	return x.log(e)
+}
+
+// prepare logs that ops[i] is about to be performed or undone if it's an
+// exchange, since whether an exchange has happened can't be told from which
+// names exist afterwards.
+func (x executor) prepare(ops []op, i int) error {
+	if ops[i].kind != opExchange {
+		return nil
+	}
+
+	return x.logEvent(eventExchanging, i)
+}
+
+func (x executor) do(ops []op, i int) error {
+	switch o := ops[i]; o.kind {
+	case opMove:
+		return x.move(o.src, o.dst)
+	case opExchange:
+		return x.exchange(o.src, o.dst, o.tmp)
+	case opCreate, opMkdir:
+		return x.create(o.dst, o.kind == opMkdir)
+	case opRemove:
+		return x.remove(o.src)
+	case opTrash:
+		var err error
+		x.trashed[i], err = x.trash(o.src)
+		return err
+	default:
+		panic(fmt.Sprintf("unknown op kind %d", o.kind))
+	}
+}
+
+func (x executor) undo(ops []op, i int) error {
+	switch o := ops[i]; o.kind {
+	case opMove:
+		return x.move(o.dst, o.src)
+	case opExchange:
+		// exchanging is its own inverse, and it's done in the same direction
+		// so that an interrupted non-atomic exchange can always be finished
+		// the same way
+		return x.exchange(o.src, o.dst, o.tmp)
+	case opCreate, opMkdir:
+		return x.uncreate(o.dst, o.kind == opMkdir)
+	case opRemove:
+		return fmt.Errorf("%q can't be restored once deleted", o.src)
+	case opTrash:
+		// where it went isn't known if we were interrupted before it was
+		// logged
+		if i >= len(x.trashed) || x.trashed[i] == "" {
+			return fmt.Errorf("%q must be restored from the trash manually",
+				o.src)
+		}
+		err := x.restore(x.trashed[i], o.src)
+		if err == nil {
+			x.trashed[i] = ""
+		}
+		return err
+	default:
+		panic(fmt.Sprintf("unknown op kind %d", o.kind))
+	}
+}
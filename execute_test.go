@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_execute(t *testing.T) {
+	ops := []op{
+		{kind: opRemove, src: "z"},
+		{kind: opTrash, src: "y"},
+		{kind: opMove, src: "a", dst: "a.tmp1"},
+		{kind: opMkdir, dst: "d"},
+		{kind: opCreate, dst: "d/e"},
+		{kind: opMove, src: "b", dst: "a"},
+		{kind: opExchange, src: "a", dst: "c", tmp: "a.tmp2"},
+		{kind: opCreate, dst: "f"},
+	}
+
+	tests := []struct {
+		description string
+		// fail is the set of calls that should fail
+		fail             map[string]bool
+		expectedCalls    []string
+		expectedErr      string
+		expectedFailures []string
+	}{
+		{
+			description: "success",
+			expectedCalls: []string{
+				`remove "z"`, `trash "y"`, `move "a" "a.tmp1"`, `create "d" true`,
+				`create "d/e" false`, `move "b" "a"`, `log exchanging 6`,
+				`exchange "a" "c" "a.tmp2"`, `create "f" false`,
+			},
+		},
+		{
+			description:   "first op fails",
+			fail:          map[string]bool{`remove "z"`: true},
+			expectedCalls: []string{`remove "z"`},
+			expectedErr:   `remove "z" failed`,
+		},
+		{
+			description: "rolled back",
+			fail:        map[string]bool{`move "b" "a"`: true},
+			expectedCalls: []string{
+				`remove "z"`, `trash "y"`, `move "a" "a.tmp1"`, `create "d" true`,
+				`create "d/e" false`, `move "b" "a"`,
+				`uncreate "d/e" false`, `uncreate "d" true`,
+				`move "a.tmp1" "a"`, `restore "y.trashed" "y"`,
+			},
+			expectedErr: `move "b" "a" failed`,
+			expectedFailures: []string{
+				`delete "z": "z" can't be restored once deleted`,
+			},
+		},
+		{
+			description: "exchange rolled back",
+			fail:        map[string]bool{`create "f" false`: true},
+			expectedCalls: []string{
+				`remove "z"`, `trash "y"`, `move "a" "a.tmp1"`, `create "d" true`,
+				`create "d/e" false`, `move "b" "a"`, `log exchanging 6`,
+				`exchange "a" "c" "a.tmp2"`, `create "f" false`,
+				`log exchanging 6`, `exchange "a" "c" "a.tmp2"`,
+				`move "a" "b"`, `uncreate "d/e" false`, `uncreate "d" true`,
+				`move "a.tmp1" "a"`, `restore "y.trashed" "y"`,
+			},
+			expectedErr: `create "f" false failed`,
+			expectedFailures: []string{
+				`delete "z": "z" can't be restored once deleted`,
+			},
+		},
+		{
+			description: "rollback fails",
+			fail: map[string]bool{
+				`create "d/e" false`: true,
+				`uncreate "d" true`:  true,
+			},
+			expectedCalls: []string{
+				`remove "z"`, `trash "y"`, `move "a" "a.tmp1"`, `create "d" true`,
+				`create "d/e" false`, `uncreate "d" true`,
+				`move "a.tmp1" "a"`, `restore "y.trashed" "y"`,
+			},
+			expectedErr: `create "d/e" false failed`,
+			expectedFailures: []string{
+				`mkdir "d": uncreate "d" true failed`,
+				`delete "z": "z" can't be restored once deleted`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var calls []string
+			call := func(format string, a ...any) error {
+				c := fmt.Sprintf(format, a...)
+				calls = append(calls, c)
+				if test.fail[c] {
+					return errors.New(c + " failed")
+				}
+				return nil
+			}
+
+			x := executor{
+				move: func(src, dst string) error {
+					return call("move %q %q", src, dst)
+				},
+				exchange: func(a, b, tmp string) error {
+					return call("exchange %q %q %q", a, b, tmp)
+				},
+				create: func(dst string, dir bool) error {
+					return call("create %q %v", dst, dir)
+				},
+				remove: func(src string) error {
+					return call("remove %q", src)
+				},
+				trash: func(src string) (string, error) {
+					return src + ".trashed", call("trash %q", src)
+				},
+				restore: func(trashed, src string) error {
+					return call("restore %q %q", trashed, src)
+				},
+				uncreate: func(dst string, dir bool) error {
+					return call("uncreate %q %v", dst, dir)
+				},
+				// only exchanging events are recorded, since the others
+				// follow from the calls
+				log: func(e journalEvent) error {
+					if e.Kind != eventExchanging {
+						return nil
+					}
+					return call("log %s %d", e.Kind, e.Op)
+				},
+			}
+
+			err := execute(ops, 0, x)
+
+			if strings.Join(calls, "\n") != strings.Join(test.expectedCalls, "\n") {
+				t.Fatalf("expected calls: %q did not match actual calls: %q",
+					test.expectedCalls, calls)
+			}
+
+			if test.expectedErr == "" {
+				requireNoError(t, err)
+				return
+			}
+			if err == nil || err.Error() != test.expectedErr {
+				t.Fatalf("expected error: %s did not match actual error: %v",
+					test.expectedErr, err)
+			}
+
+			var actualFailures []string
+			var rbErr *rollbackError
+			if errors.As(err, &rbErr) {
+				for _, f := range rbErr.failures {
+					actualFailures = append(actualFailures,
+						fmt.Sprintf("%s: %s", f.op, f.err))
+				}
+			}
+			if strings.Join(actualFailures, "\n") != strings.Join(test.expectedFailures, "\n") {
+				t.Fatalf("expected rollback failures: %q did not match actual "+
+					"rollback failures: %q", test.expectedFailures,
+					actualFailures)
+			}
+		})
+	}
+}
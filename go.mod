@@ -4,7 +4,6 @@ go 1.19
 
 require (
 	github.com/alecthomas/kong v0.6.1
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 	golang.org/x/term v0.1.0
 )
-
-require golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
@@ -0,0 +1,829 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// journalIDLayout is the layout of journal IDs, which are the times of the
+// runs they record, so that they sort chronologically
+const journalIDLayout = "20060102-150405.000000"
+
+// a journal records the ops of a run, so that it can be recovered if it's
+// interrupted, and undone once it's finished
+type journal struct {
+	// Dir is the absolute path of the directory the ops are performed in
+	Dir  string    `json:"dir"`
+	Time time.Time `json:"time"`
+	// Undoes is the ID of the journal whose ops these undo, if any
+	Undoes string `json:"undoes,omitempty"`
+	Ops    []op   `json:"ops"`
+	// Tmps are the temporary names used by the ops, which are checked for
+	// anything that was left behind once they're finished
+	Tmps []string `json:"tmps,omitempty"`
+}
+
+var opKindNames = [...]string{
+	opMove:     "move",
+	opCreate:   "create",
+	opMkdir:    "mkdir",
+	opRemove:   "delete",
+	opTrash:    "trash",
+	opExchange: "exchange",
+}
+
+func (k opKind) MarshalText() ([]byte, error) {
+	if k < 0 || int(k) >= len(opKindNames) {
+		return nil, fmt.Errorf("unknown op kind %d", k)
+	}
+
+	return []byte(opKindNames[k]), nil
+}
+
+func (k *opKind) UnmarshalText(text []byte) error {
+	for i, name := range opKindNames {
+		if string(text) == name {
+			*k = opKind(i)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown op kind %q", text)
+}
+
+// jsonOp is how ops are represented in journals
+type jsonOp struct {
+	Kind opKind `json:"kind"`
+	Src  string `json:"src,omitempty"`
+	Dst  string `json:"dst,omitempty"`
+	Tmp  string `json:"tmp,omitempty"`
+}
+
+func (o op) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonOp{Kind: o.kind, Src: o.src, Dst: o.dst,
+		Tmp: o.tmp})
+}
+
+func (o *op) UnmarshalJSON(data []byte) error {
+	var j jsonOp
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+
+	*o = op{kind: j.Kind, src: j.Src, dst: j.Dst, tmp: j.Tmp}
+	return nil
+}
+
+// an eventKind is something that can happen to an op while it's being
+// performed
+type eventKind string
+
+const (
+	eventDone   eventKind = "done"
+	eventFailed eventKind = "failed"
+	eventUndone eventKind = "undone"
+	// eventExchanging is logged before an exchange is performed or undone
+	eventExchanging eventKind = "exchanging"
+	// eventCopying is logged before a copy is made under a temporary name,
+	// while an op moves something across filesystems
+	eventCopying eventKind = "copying"
+	// eventCopied is logged once a copy has been renamed into place, before
+	// what was copied is removed
+	eventCopied eventKind = "copied"
+)
+
+// a journalEvent records something that happened to one of a journal's ops.
+// Events are appended to the journal after its header, one per line.
+type journalEvent struct {
+	Kind eventKind `json:"event"`
+	Op   int       `json:"op"`
+	// Ino is the inode number of the src of an exchange when it's logged as
+	// exchanging, which is used to tell whether the exchange happened
+	Ino uint64 `json:"ino,omitempty"`
+	// Trashed is the absolute path that the src of a trash op ended up at
+	// when it's logged as done, which is used to restore it
+	Trashed string `json:"trashed,omitempty"`
+	// Tmp is the temporary name a copy is made under when it's logged as
+	// copying
+	Tmp string `json:"tmp,omitempty"`
+	// Src is what was copied when it's logged as copied, which is removed
+	// once the copy is in place
+	Src string `json:"src,omitempty"`
+}
+
+// journalState is what the events in a journal say about its ops
+type journalState struct {
+	// performed[i] is set once ops[i] has been performed, and cleared again
+	// if it's undone
+	performed []bool
+	// trashed[i] is where the src of ops[i] ended up if it was trashed, and
+	// that's been logged
+	trashed []string
+	// rollingBack is set once an op has failed or been undone
+	rollingBack bool
+	// pending is the index of the op that may have been performed, or undone
+	// when rolling back, without that being logged, or -1 if there isn't one
+	pending int
+	// exchanging is set if the pending op is an exchange that was about to
+	// be performed or undone, in which case exchangingIno is the inode number
+	// its src had beforehand
+	exchanging    bool
+	exchangingIno uint64
+	// copies are the temporary names that copies were made under, which
+	// only still exist if the copies weren't finished
+	copies []string
+	// copied is what was copied if the last event was that its copy was
+	// renamed into place, in which case it may not have been removed yet
+	copied string
+}
+
+func newJournalState(n int) journalState {
+	s := journalState{performed: make([]bool, n), trashed: make([]string, n),
+		pending: 0}
+	if n == 0 {
+		s.pending = -1
+	}
+
+	return s
+}
+
+func (s *journalState) apply(e journalEvent) error {
+	if e.Op < 0 || e.Op >= len(s.performed) {
+		return fmt.Errorf("event for unknown op %d", e.Op)
+	}
+
+	// the copied event is only ever the last one while the original is
+	// being removed
+	s.copied = ""
+	if e.Kind == eventCopied {
+		s.copied = e.Src
+		return nil
+	}
+	if e.Kind == eventCopying {
+		s.copies = append(s.copies, e.Tmp)
+		return nil
+	}
+	if e.Kind == eventExchanging {
+		s.exchanging, s.exchangingIno = true, e.Ino
+		return nil
+	}
+	s.exchanging, s.exchangingIno = false, 0
+
+	switch e.Kind {
+	case eventDone:
+		s.performed[e.Op] = true
+		s.trashed[e.Op] = e.Trashed
+		s.pending = e.Op + 1
+		if s.pending == len(s.performed) {
+			s.pending = -1
+		}
+
+	case eventFailed, eventUndone:
+		if e.Kind == eventUndone {
+			s.performed[e.Op] = false
+			s.trashed[e.Op] = ""
+		}
+		s.rollingBack = true
+
+		// ops are undone in the opposite order, so the next one that will
+		// be is the one before this that's still performed
+		s.pending = -1
+		for i := e.Op - 1; i >= 0; i-- {
+			if s.performed[i] {
+				s.pending = i
+				break
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown event %q", e.Kind)
+	}
+
+	return nil
+}
+
+// performedOps returns the ops that have been performed, in order.
+func (s *journalState) performedOps(ops []op) []op {
+	var performed []op
+	for i, o := range ops {
+		if s.performed[i] {
+			performed = append(performed, o)
+		}
+	}
+
+	return performed
+}
+
+// decodeJournal reads a journal from r. If the journal ends with an
+// incomplete line, because we were interrupted while writing it, that line is
+// ignored. n is the length of the journal up to that line.
+func decodeJournal(r io.Reader) (j journal, s journalState, n int64, err error) {
+	br := bufio.NewReader(r)
+
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return j, s, 0, fmt.Errorf("reading header failed: %w", err)
+	}
+	err = json.Unmarshal(line, &j)
+	if err != nil {
+		return j, s, 0, fmt.Errorf("decoding header failed: %w", err)
+	}
+	n = int64(len(line))
+
+	s = newJournalState(len(j.Ops))
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return j, s, n, nil
+		} else if err != nil {
+			return j, s, n, err
+		}
+
+		var e journalEvent
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return j, s, n, fmt.Errorf("decoding event failed: %w", err)
+		}
+		err = s.apply(e)
+		if err != nil {
+			return j, s, n, err
+		}
+		n += int64(len(line))
+	}
+}
+
+// journalDir returns the directory in which journals are stored, which is
+// within $XDG_STATE_HOME, or ~/.local/state if that isn't set.
+func journalDir() (string, error) {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(stateHome, "vimv2"), nil
+}
+
+// journalPath returns the path of the journal with the given ID, and ext,
+// which is .wal while its ops are being performed, and .json once they're
+// finished.
+func journalPath(id, ext string) (string, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid journal ID %q", id)
+	}
+
+	dir, err := journalDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, id+ext), nil
+}
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+// a journalWriter is a journal whose ops are being performed. Events are
+// synced to disk as they're logged, so that if we're interrupted, the journal
+// can be used to recover. The journal is locked until it's finished, so that
+// other processes can tell it's still in progress.
+type journalWriter struct {
+	journal
+	journalState
+	id string
+	f  *os.File
+}
+
+// createJournal writes the header of a new journal containing j, and returns
+// a journalWriter for it. The header is synced to disk before this returns,
+// so that nothing is performed before it's been recorded.
+func createJournal(j journal) (*journalWriter, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	id := j.Time.Format(journalIDLayout)
+	p := filepath.Join(dir, id+".wal")
+
+	// the header is written under another name first, so that other
+	// processes never see the journal before it's complete and locked
+	f, err := os.OpenFile(p+".tmp", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		err := lockFile(f)
+		if err != nil {
+			return err
+		}
+		err = json.NewEncoder(f).Encode(j)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if err != nil {
+			return err
+		}
+		err = os.Rename(p+".tmp", p)
+		if err != nil {
+			return err
+		}
+
+		return syncDir(dir)
+	}()
+	if err != nil {
+		f.Close()
+		os.Remove(p + ".tmp")
+		return nil, err
+	}
+
+	return &journalWriter{journal: j, journalState: newJournalState(len(j.Ops)),
+		id: id, f: f}, nil
+}
+
+// openJournal opens the journal of a run that was interrupted, so that it can
+// be recovered.
+func openJournal(id string) (*journalWriter, error) {
+	p, err := journalPath(id, ".wal")
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no interrupted run with ID %q", id)
+	} else if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		err := lockFile(f)
+		if errors.Is(err, errLocked) {
+			return fmt.Errorf("run %s is still in progress", id)
+		} else if err != nil {
+			return err
+		}
+
+		return nil
+	}()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w := &journalWriter{id: id, f: f}
+	var n int64
+	w.journal, w.journalState, n, err = decodeJournal(f)
+	if err == nil {
+		// drop any incomplete line, so that what we log next is readable
+		err = f.Truncate(n)
+	}
+	if err == nil {
+		_, err = f.Seek(n, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// log appends an event to the journal and syncs it to disk.
+func (w *journalWriter) log(kind eventKind, i int) error {
+	return w.logEvent(journalEvent{Kind: kind, Op: i})
+}
+
+// logger returns a function that logs events for ops performed within d, for
+// use by an executor. The inode numbers of the srcs of exchanges are looked
+// up in d.
+func (w *journalWriter) logger(d *dir) func(e journalEvent) error {
+	return func(e journalEvent) error {
+		if e.Kind == eventExchanging {
+			info, err := d.lstat(w.Ops[e.Op].src)
+			if err != nil {
+				return err
+			}
+			_, e.Ino, _ = fileID(info)
+		}
+
+		return w.logEvent(e)
+	}
+}
+
+func (w *journalWriter) logEvent(e journalEvent) error {
+	err := w.apply(e)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return w.f.Sync()
+}
+
+// copyTmps returns a tmpFunc that provides names from t for copies made
+// while performing the journal's ops, and logs each one before it's used, so
+// that copies that are interrupted can be found.
+func (w *journalWriter) copyTmps(t *tmpNamer) tmpFunc {
+	return func(dst string) (string, error) {
+		tmp, err := t.name(dst)
+		if err != nil {
+			return "", err
+		}
+
+		return tmp, w.logEvent(journalEvent{Kind: eventCopying, Op: w.pending,
+			Tmp: tmp})
+	}
+}
+
+// logCopied logs that a copy of src has been renamed into place, so that if
+// we're interrupted while src is being removed, it can be removed completely.
+func (w *journalWriter) logCopied(src string) error {
+	return w.logEvent(journalEvent{Kind: eventCopied, Op: w.pending, Src: src})
+}
+
+// reconcile removes copies that were interrupted, and the rest of anything
+// that was being removed once its copy was in place, then checks whether the
+// pending op was performed, or undone when rolling back, by looking at the
+// filesystem, and logs it if it was.
+func (w *journalWriter) reconcile(d *dir) error {
+	// copies are renamed into place once they're complete, so any that are
+	// still under their temporary names are incomplete
+	for _, tmp := range w.copies {
+		exists, err := lexists(d, tmp)
+		if errors.Is(err, syscall.ENOTDIR) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if exists {
+			err = d.removeAll(tmp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.copied != "" {
+		exists, err := lexists(d, w.copied)
+		if err != nil {
+			return err
+		}
+		if exists {
+			err = d.removeAll(w.copied)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.pending == -1 {
+		return nil
+	}
+
+	var performed bool
+	var err error
+	if o := w.Ops[w.pending]; o.kind == opExchange {
+		var exchanged bool
+		exchanged, err = w.exchanged(d, o)
+		// undoing an exchange is the same as performing it
+		performed = exchanged != w.rollingBack
+	} else {
+		performed, err = appearsPerformed(d, o)
+	}
+	if err != nil {
+		return err
+	}
+
+	if w.rollingBack && !performed {
+		return w.log(eventUndone, w.pending)
+	}
+	if !w.rollingBack && performed {
+		return w.log(eventDone, w.pending)
+	}
+
+	return nil
+}
+
+// exchanged reports whether the pending exchange o happened since it was
+// logged as exchanging. If it was interrupted part way through an exchange
+// that wasn't atomic, the exchange is finished first.
+func (w *journalWriter) exchanged(d *dir, o op) (bool, error) {
+	if !w.exchanging {
+		return false, nil
+	}
+
+	_, err := d.lstat(o.tmp)
+	if err == nil {
+		// src was moved to tmp, and dst may have been moved to src
+		_, err = d.lstat(o.src)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = d.move(o.dst, o.src)
+		}
+		if err != nil {
+			return false, err
+		}
+		err = d.move(o.tmp, o.dst)
+		if err != nil {
+			return false, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	info, err := d.lstat(o.src)
+	if err != nil {
+		return false, err
+	}
+	_, ino, _ := fileID(info)
+	return ino != w.exchangingIno, nil
+}
+
+// appearsPerformed reports whether the filesystem looks like o has been
+// performed. It's only meaningful for the op after the last one that's known
+// to have been performed.
+func appearsPerformed(d *dir, o op) (bool, error) {
+	exists := func(name string) (bool, error) { return lexists(d, name) }
+
+	switch o.kind {
+	case opMove:
+		srcExists, err := exists(o.src)
+		if err != nil || srcExists {
+			return false, err
+		}
+		return exists(o.dst)
+	case opCreate, opMkdir:
+		return exists(o.dst)
+	case opRemove, opTrash:
+		srcExists, err := exists(o.src)
+		return !srcExists, err
+	default:
+		panic(fmt.Sprintf("unknown op kind %d", o.kind))
+	}
+}
+
+// finish marks the journal as no longer in progress. If it's not part of an
+// undo, and there are moves that were performed, it's kept so that they can
+// be undone, otherwise it's removed.
+func (w *journalWriter) finish() error {
+	base, err := journalPath(w.id, "")
+	if err != nil {
+		return err
+	}
+
+	if w.Undoes == "" && len(netMoves(w.performedOps(w.Ops))) > 0 {
+		err = os.Rename(base+".wal", base+".json")
+	} else {
+		err = os.Remove(base + ".wal")
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(base))
+	}
+
+	// closing releases the lock, so it has to happen last
+	closeErr := w.f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// keep leaves the journal as if its run was interrupted, so that it can be
+// recovered later, and releases its lock.
+func (w *journalWriter) keep() error {
+	return w.f.Close()
+}
+
+// readJournal reads the finished journal with the given ID. Only the ops that
+// were performed are included in the result.
+func readJournal(id string) (journal, error) {
+	p, err := journalPath(id, ".json")
+	if err != nil {
+		return journal{}, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return journal{}, fmt.Errorf("no journal with ID %q", id)
+	} else if err != nil {
+		return journal{}, err
+	}
+	defer f.Close()
+
+	j, s, _, err := decodeJournal(f)
+	j.Ops = s.performedOps(j.Ops)
+	return j, err
+}
+
+// removeJournal removes the finished journal with the given ID.
+func removeJournal(id string) error {
+	p, err := journalPath(id, ".json")
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p)
+}
+
+// latestJournal returns the ID of the most recent finished journal.
+func latestJournal() (string, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	// entries are sorted by filename, and therefore by time
+	for i := len(entries) - 1; i >= 0; i-- {
+		id := strings.TrimSuffix(entries[i].Name(), ".json")
+		if id != entries[i].Name() {
+			return id, nil
+		}
+	}
+
+	return "", errors.New("no journals found")
+}
+
+// interruptedJournals returns the IDs of the journals of runs that were
+// interrupted, oldest first.
+func interruptedJournals() ([]string, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".wal")
+		if id == entry.Name() {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if errors.Is(err, fs.ErrNotExist) {
+			// it was just finished
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		err = lockFile(f)
+		f.Close()
+		if errors.Is(err, errLocked) {
+			// it's still in progress
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// netMoves returns the overall effect of the moves in ops, as a map from
+// where things were originally to where they ended up. Things that ended up
+// back where they started are omitted, as are things that were only moved
+// along with their parent directories.
+func netMoves(ops []op) map[string]string {
+	// maps where things are now to where they were originally
+	origs := map[string]string{}
+	// holds the keys of origs beneath each directory
+	beneath := pathIndex{}
+
+	for _, o := range ops {
+		// an exchange is two moves that happen at once
+		var moves [][2]string
+		switch o.kind {
+		case opMove:
+			moves = [][2]string{{o.src, o.dst}}
+		case opExchange:
+			moves = [][2]string{{o.src, o.dst}, {o.dst, o.src}}
+		default:
+			continue
+		}
+
+		moved := map[string]string{}
+		for _, m := range moves {
+			// things inside directories that were moved earlier started out
+			// inside where those directories were originally
+			orig := m[0]
+			if parent, found := findParent(m[0], origs); found {
+				orig = origs[parent] + m[0][len(parent):]
+			}
+			moved[m[1]] = orig
+		}
+		// only the things at or beneath the sources are affected, so they're
+		// the only ones that need to be looked at
+		for _, m := range moves {
+			affected := []string{m[0]}
+			for cur := range beneath[m[0]] {
+				affected = append(affected, cur)
+			}
+			for _, cur := range affected {
+				orig, ok := origs[cur]
+				if !ok {
+					continue
+				}
+				moved[m[1]+cur[len(m[0]):]] = orig
+				delete(origs, cur)
+				beneath.remove(cur)
+			}
+		}
+		for cur, orig := range moved {
+			origs[cur] = orig
+			beneath.add(cur)
+		}
+	}
+
+	srcToDst := map[string]string{}
+	for cur, orig := range origs {
+		if cur != orig {
+			srcToDst[orig] = cur
+		}
+	}
+
+	return srcToDst
+}
+
+// undoOps returns the ops that undo the moves recorded in j, after verifying
+// that the things that were moved are still where they ended up, and that
+// nothing else is where they started. The temporary names they use come from
+// t, which is set up to avoid everything they involve. Other ops can't be
+// undone, so they're ignored.
+func undoOps(d *dir, j journal, t *tmpNamer) ([]op, error) {
+	dstToSrc := map[string]string{}
+	srcSet := map[string]struct{}{}
+	for src, dst := range netMoves(j.Ops) {
+		dstToSrc[dst] = src
+		srcSet[src] = struct{}{}
+	}
+
+	dsts := make([]string, 0, len(dstToSrc))
+	for dst := range dstToSrc {
+		dsts = append(dsts, dst)
+	}
+	sort.Strings(dsts)
+
+	for _, dst := range dsts {
+		_, err := d.lstat(dst)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%q no longer exists", dst)
+		} else if err != nil {
+			return nil, err
+		}
+
+		// sources are free if whatever's there now is being moved away
+		src := dstToSrc[dst]
+		_, movedAway := dstToSrc[src]
+		if _, found := findParent(src, dstToSrc); movedAway || found {
+			continue
+		}
+
+		_, err = d.lstat(src)
+		if err == nil {
+			return nil, fmt.Errorf("%q already exists", src)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	r := &recorder{}
+	t.taken = takenIn(dstToSrc, srcSet, d)
+	err := moveAll(dstToSrc, nil, r.move, r.exchanger(), r.create, t.name)
+	return r.ops, err
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile would take an exclusive lock on f, but that isn't supported on
+// this platform, so runs that are still in progress look like they were
+// interrupted to other processes.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// syncDir would flush the entries of the directory p to disk, but
+// directories can't be synced on this platform.
+func syncDir(p string) error {
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_netMoves(t *testing.T) {
+	tests := []struct {
+		description string
+		ops         []op
+		expected    map[string]string
+	}{
+		{
+			description: "simple",
+			ops: []op{
+				{kind: opRemove, src: "z"},
+				{kind: opMove, src: "a", dst: "b"},
+				{kind: opCreate, dst: "c"},
+			},
+			expected: map[string]string{"a": "b"},
+		},
+		{
+			description: "swap",
+			ops: []op{
+				{kind: opMove, src: "a", dst: "a.tmp1"},
+				{kind: opMove, src: "b", dst: "a"},
+				{kind: opMove, src: "a.tmp1", dst: "b"},
+			},
+			expected: map[string]string{"a": "b", "b": "a"},
+		},
+		{
+			description: "exchange",
+			ops: []op{
+				{kind: opMove, src: "c", dst: "a/c"},
+				{kind: opExchange, src: "a", dst: "b"},
+			},
+			expected: map[string]string{"a": "b", "b": "a", "c": "b/c"},
+		},
+		{
+			description: "moved back",
+			ops: []op{
+				{kind: opMove, src: "a", dst: "b"},
+				{kind: opMove, src: "b", dst: "a"},
+			},
+			expected: map[string]string{},
+		},
+		{
+			description: "directory and its contents",
+			ops: []op{
+				{kind: opMove, src: "a/x", dst: "a/y"},
+				{kind: opMove, src: "a", dst: "b"},
+				{kind: opMove, src: "c", dst: "b/c"},
+			},
+			expected: map[string]string{
+				"a":   "b",
+				"a/x": "b/y",
+				"c":   "b/c",
+			},
+		},
+		{
+			description: "contents of moved directory",
+			ops: []op{
+				{kind: opMove, src: "a", dst: "c"},
+				{kind: opMove, src: "c/x", dst: "c/x2"},
+			},
+			expected: map[string]string{"a": "c", "a/x": "c/x2"},
+		},
+		{
+			description: "contents of exchanged directory",
+			ops: []op{
+				{kind: opExchange, src: "a", dst: "b"},
+				{kind: opMove, src: "a/x", dst: "b/x2"},
+			},
+			expected: map[string]string{"a": "b", "b": "a", "b/x": "b/x2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			actual := netMoves(test.ops)
+			if !reflect.DeepEqual(test.expected, actual) {
+				t.Fatalf("expected: %v did not match actual: %v",
+					test.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_netMoves_large(t *testing.T) {
+	for description, test := range largePlans(10000) {
+		for _, exchange := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s exchange=%v", description, exchange), func(t *testing.T) {
+				srcToDst := map[string]string{}
+				expected := map[string]string{}
+				for src, dst := range test {
+					srcToDst[src] = dst
+					expected[dst] = src
+				}
+
+				r := &recorder{}
+				var exchangeFn exchangeFunc
+				if exchange {
+					exchangeFn = r.exchange
+				}
+				err := moveAll(srcToDst, nil, r.move, exchangeFn, nil,
+					testTmpFunc(map[string]string{}, expected))
+				requireNoError(t, err)
+
+				assertMapsEqual(t, test, netMoves(r.ops))
+			})
+		}
+	}
+}
+
+func Test_journal_json(t *testing.T) {
+	expected := journal{
+		Dir:  "/a",
+		Time: time.Date(2000, 1, 2, 3, 4, 5, 6, time.UTC),
+		Ops: []op{
+			{kind: opMove, src: "a", dst: "b"},
+			{kind: opCreate, dst: "c"},
+			{kind: opMkdir, dst: "d"},
+			{kind: opRemove, src: "e"},
+			{kind: opTrash, src: "f"},
+			{kind: opExchange, src: "g", dst: "h", tmp: "g.tmp1"},
+		},
+		Tmps: []string{"g.tmp1"},
+	}
+
+	b, err := json.Marshal(expected)
+	requireNoError(t, err)
+
+	expectedJSON := `{"dir":"/a","time":"2000-01-02T03:04:05.000000006Z",` +
+		`"ops":[{"kind":"move","src":"a","dst":"b"},` +
+		`{"kind":"create","dst":"c"},{"kind":"mkdir","dst":"d"},` +
+		`{"kind":"delete","src":"e"},{"kind":"trash","src":"f"},` +
+		`{"kind":"exchange","src":"g","dst":"h","tmp":"g.tmp1"}],` +
+		`"tmps":["g.tmp1"]}`
+	if string(b) != expectedJSON {
+		t.Fatalf("expected json: %s did not match actual json: %s",
+			expectedJSON, b)
+	}
+
+	var actual journal
+	requireNoError(t, json.Unmarshal(b, &actual))
+	if fmt.Sprint(expected) != fmt.Sprint(actual) {
+		t.Fatalf("expected: %v did not match actual: %v", expected, actual)
+	}
+}
+
+func Test_decodeJournal(t *testing.T) {
+	header := `{"dir":"/a","time":"2000-01-01T00:00:00Z","ops":[` +
+		`{"kind":"move","src":"a","dst":"b"},{"kind":"mkdir","dst":"c"},` +
+		`{"kind":"move","src":"d","dst":"c/d"}]}` + "\n"
+
+	tests := []struct {
+		description         string
+		events              string
+		expectedPerformed   []bool
+		expectedRollingBack bool
+		expectedPending     int
+		expectedErr         string
+	}{
+		{
+			description:       "no events",
+			expectedPerformed: []bool{false, false, false},
+			expectedPending:   0,
+		},
+		{
+			description:       "some done",
+			events:            `{"event":"done","op":0}` + "\n",
+			expectedPerformed: []bool{true, false, false},
+			expectedPending:   1,
+		},
+		{
+			description: "all done",
+			events: `{"event":"done","op":0}` + "\n" +
+				`{"event":"done","op":1}` + "\n" +
+				`{"event":"done","op":2}` + "\n",
+			expectedPerformed: []bool{true, true, true},
+			expectedPending:   -1,
+		},
+		{
+			description: "incomplete line",
+			events: `{"event":"done","op":0}` + "\n" +
+				`{"event":"done",`,
+			expectedPerformed: []bool{true, false, false},
+			expectedPending:   1,
+		},
+		{
+			description: "rolling back",
+			events: `{"event":"done","op":0}` + "\n" +
+				`{"event":"done","op":1}` + "\n" +
+				`{"event":"failed","op":2}` + "\n" +
+				`{"event":"undone","op":1}` + "\n",
+			expectedPerformed:   []bool{true, false, false},
+			expectedRollingBack: true,
+			expectedPending:     0,
+		},
+		{
+			description: "unknown op",
+			events:      `{"event":"done","op":3}` + "\n",
+			expectedErr: "event for unknown op 3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, s, n, err := decodeJournal(strings.NewReader(header + test.events))
+
+			if test.expectedErr != "" {
+				if err == nil || err.Error() != test.expectedErr {
+					t.Fatalf("expected error: %s did not match actual error: %v",
+						test.expectedErr, err)
+				}
+				return
+			}
+
+			requireNoError(t, err)
+			expected := fmt.Sprint(test.expectedPerformed,
+				test.expectedRollingBack, test.expectedPending)
+			actual := fmt.Sprint(s.performed, s.rollingBack, s.pending)
+			if expected != actual {
+				t.Fatalf("expected: %s did not match actual: %s",
+					expected, actual)
+			}
+
+			complete := strings.LastIndexByte(test.events, '\n') + 1
+			if n != int64(len(header)+complete) {
+				t.Fatalf("expected length: %d did not match actual length: %d",
+					len(header)+complete, n)
+			}
+		})
+	}
+}
+
+func Test_journalWriter_reconcile_exchange(t *testing.T) {
+	tests := []struct {
+		description string
+		// interrupt does whatever happened to a and b before we were
+		// interrupted
+		interrupt         func(t *testing.T, tempDir string)
+		expectedPerformed bool
+		expectedA         string
+	}{
+		{
+			description:       "not started",
+			interrupt:         func(t *testing.T, tempDir string) {},
+			expectedPerformed: false,
+			expectedA:         "a",
+		},
+		{
+			description: "part way through",
+			interrupt: func(t *testing.T, tempDir string) {
+				requireNoError(t, os.Rename(filepath.Join(tempDir, "a"),
+					filepath.Join(tempDir, "a.tmp1")))
+			},
+			expectedPerformed: true,
+			expectedA:         "b",
+		},
+		{
+			description: "finished",
+			interrupt: func(t *testing.T, tempDir string) {
+				for _, m := range [][2]string{{"a", "a.tmp1"}, {"b", "a"}, {"a.tmp1", "b"}} {
+					requireNoError(t, os.Rename(filepath.Join(tempDir, m[0]),
+						filepath.Join(tempDir, m[1])))
+				}
+			},
+			expectedPerformed: true,
+			expectedA:         "b",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Setenv("XDG_STATE_HOME", t.TempDir())
+			d, tempDir := openTempDir(t)
+
+			requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a"), []byte("a"), 0o644))
+			requireNoError(t, os.WriteFile(filepath.Join(tempDir, "b"), []byte("b"), 0o644))
+
+			w, err := createJournal(journal{Dir: tempDir, Time: time.Now(),
+				Ops: []op{{kind: opExchange, src: "a", dst: "b", tmp: "a.tmp1"}}})
+			requireNoError(t, err)
+			requireNoError(t, w.logger(d)(journalEvent{Kind: eventExchanging, Op: 0}))
+			test.interrupt(t, tempDir)
+			requireNoError(t, w.f.Close())
+
+			w, err = openJournal(w.id)
+			requireNoError(t, err)
+			requireNoError(t, w.reconcile(d))
+			requireNoError(t, w.f.Close())
+
+			if w.performed[0] != test.expectedPerformed {
+				t.Fatalf("expected performed: %v did not match actual "+
+					"performed: %v", test.expectedPerformed, w.performed[0])
+			}
+			b, err := os.ReadFile(filepath.Join(tempDir, "a"))
+			requireNoError(t, err)
+			if string(b) != test.expectedA {
+				t.Fatalf("expected a to contain: %q but it contained: %q",
+					test.expectedA, b)
+			}
+		})
+	}
+}
+
+func Test_journalWriter_reconcile_copies(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a"), []byte("a"), 0o644))
+
+	w, err := createJournal(journal{Dir: tempDir, Time: time.Now(),
+		Ops: []op{{kind: opMove, src: "a", dst: "b"}}})
+	requireNoError(t, err)
+	tn := &tmpNamer{pattern: defaultTmpPattern, session: "s",
+		taken: takenIn[string, string](nil, nil, d)}
+	tmp, err := w.copyTmps(tn)("b")
+	requireNoError(t, err)
+	// we were interrupted part way through copying
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, tmp), nil, 0o600))
+	requireNoError(t, w.f.Close())
+
+	w, err = openJournal(w.id)
+	requireNoError(t, err)
+	requireNoError(t, w.reconcile(d))
+	requireNoError(t, w.f.Close())
+
+	if !reflect.DeepEqual([]string{".vimv2-s-1"}, w.copies) {
+		t.Fatalf("expected copies: %q did not match actual copies: %q",
+			[]string{".vimv2-s-1"}, w.copies)
+	}
+	_, err = os.Lstat(filepath.Join(tempDir, tmp))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected the copy to have been removed, but got: %v", err)
+	}
+	if w.performed[0] {
+		t.Fatal("expected the move not to have been performed")
+	}
+}
+
+func Test_journalWriter_reconcile_copied(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.MkdirAll(filepath.Join(tempDir, "a"), 0o755))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a", "x"), nil, 0o644))
+	requireNoError(t, os.MkdirAll(filepath.Join(tempDir, "b"), 0o755))
+
+	w, err := createJournal(journal{Dir: tempDir, Time: time.Now(),
+		Ops: []op{{kind: opMove, src: "a", dst: "b"}}})
+	requireNoError(t, err)
+	requireNoError(t, w.logEvent(journalEvent{Kind: eventCopying, Op: 0,
+		Tmp: ".vimv2-s-1"}))
+	// we were interrupted after the copy was renamed into place, but before
+	// a was removed completely
+	requireNoError(t, w.logCopied("a"))
+	requireNoError(t, w.f.Close())
+
+	w, err = openJournal(w.id)
+	requireNoError(t, err)
+	requireNoError(t, w.reconcile(d))
+	requireNoError(t, w.f.Close())
+
+	_, err = os.Lstat(filepath.Join(tempDir, "a"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected a to have been removed, but got: %v", err)
+	}
+	if !w.performed[0] {
+		t.Fatal("expected the move to have been performed")
+	}
+}
+
+// writeJournal writes a journal containing j, in which the first performed
+// ops have been logged as done. If finished isn't set, the journal is left as
+// if the run was interrupted.
+func writeJournal(t *testing.T, j journal, performed int, finished bool) {
+	t.Helper()
+
+	w, err := createJournal(j)
+	requireNoError(t, err)
+	for i := 0; i < performed; i++ {
+		requireNoError(t, w.log(eventDone, i))
+	}
+
+	if finished {
+		requireNoError(t, w.finish())
+	} else {
+		requireNoError(t, w.f.Close())
+	}
+}
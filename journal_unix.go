@@ -0,0 +1,39 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an exclusive lock on f without blocking. The lock is
+// released when f is closed.
+func lockFile(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return errLocked
+	} else if err != nil {
+		return &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+
+	return nil
+}
+
+// syncDir flushes the entries of the directory p to disk, so that files that
+// were created, renamed or removed within it stay that way.
+func syncDir(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
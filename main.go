@@ -2,219 +2,933 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"os/exec"
+	"path"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"golang.org/x/term"
 )
 
 var cli struct {
-	Directory string `arg:"" default:"." type:"existingdir" help:"The directory in which you want to rename files."`
+	TmpPattern string `default:"${default_tmp_pattern}" placeholder:"PATTERN" help:"The pattern of the names things are moved to temporarily, in which {session} is replaced with the ID of the run, and {n} with a number."`
+
+	Rename struct {
+		Recursive bool   `short:"r" help:"List the contents of subdirectories too."`
+		MaxDepth  int    `placeholder:"N" help:"List the contents of subdirectories up to N levels deep. Implies --recursive."`
+		Numbered  bool   `short:"n" help:"Number the lines of the buffer so they can be reordered, and deleted to delete the corresponding files."`
+		Trash     bool   `xor:"trash" help:"Move deleted files to the trash instead of deleting them."`
+		DryRun    bool   `xor:"output" help:"Print what would be done, in order, instead of doing it."`
+		Script    string `xor:"trash,output" placeholder:"FILE" help:"Write a shell script that does what would be done to FILE, or - for stdout, instead of doing it."`
+
+		Editor     string   `placeholder:"COMMAND" env:"VIMV2_EDITOR" help:"The editor command to use, instead of $$EDITOR or $$VISUAL."`
+		Filter     string   `xor:"edit" placeholder:"COMMAND" help:"Pipe the buffer through COMMAND instead of editing it. The editor is only used if the result is invalid."`
+		Expression []string `short:"e" xor:"edit" sep:"none" placeholder:"s/REGEX/REPL/FLAGS" help:"Rename files by applying a substitution to their names instead of editing them. Can be repeated to apply several in order. Flags are g to replace every match, i to ignore case, and s or x to only replace within the stem or extension."`
+		Template   string   `short:"t" xor:"edit" placeholder:"TEMPLATE" help:"Rename files to names made from TEMPLATE instead of editing them, like '{n:03}-{stem|lower}{ext}'. Fields are name, stem, ext, parent, size, mtime and ctime (with a time layout, like {mtime:2006-01-02}), and n (a counter, like {n:WIDTH:START:STEP}), and filters are lower and upper."`
+		From       string   `xor:"edit" placeholder:"FILE" help:"Rename files as listed in FILE, or - for stdin, instead of editing them. FILE has a source and destination on each line, separated by a tab, with names quoted like they are in the buffer."`
+		FromFormat string   `enum:"auto,tsv,csv,nul" default:"auto" placeholder:"FORMAT" help:"The format of --from, which is tsv, csv, or nul for NUL-terminated sources and destinations. By default, it's csv if FILE ends with .csv, and tsv otherwise."`
+		Edit       bool     `help:"Edit the results of --filter, --from, --template, or -e before using them."`
+
+		Null bool `short:"0" help:"Read NUL-separated paths from stdin, instead of one per line."`
+
+		Paths []string `arg:"" optional:"" help:"The directory in which you want to rename files, or the paths of the files you want to rename, or - to read them from stdin. Defaults to the current directory."`
+	} `cmd:"" default:"withargs" help:"Rename files in a directory with your editor. This is the default command."`
+
+	Undo struct {
+		ID string `arg:"" optional:"" help:"The ID of the run to undo, which is the name of its journal without the extension. Defaults to the most recent run that hasn't been undone."`
+	} `cmd:"" help:"Undo the moves made by a previous run."`
+
+	Recover struct {
+		ID       string `arg:"" optional:"" help:"The ID of the interrupted run to recover. Defaults to the most recent one."`
+		Rollback bool   `help:"Roll back the run instead of finishing it."`
+	} `cmd:"" help:"Finish or roll back a run that was interrupted."`
 }
 
 // aliased to allow for test mocking
 var exit = os.Exit
 
 func main() {
-	kong.Parse(&cli)
+	ctx := kong.Parse(&cli,
+		kong.Vars{"default_tmp_pattern": defaultTmpPattern})
 
 	// default to exit code 0, and defer an explicit exit with it
-	exitCode := 0
-	defer func() { exit(exitCode) }()
-
-	warn := func(format string, a ...any) {
-		fmt.Fprintf(os.Stderr, "%s: ", os.Args[0])
-		fmt.Fprintf(os.Stderr, format, a...)
-		fmt.Fprintln(os.Stderr)
-	}
-	die := func(format string, a ...any) {
-		warn(format, a...)
-		exitCode = 1
-		// we use this instead of os.Exit so that we can run all cleanup that's
-		// been deferred up 'till this point
+	a := &app{}
+	defer func() { exit(a.exitCode) }()
+	defer func() {
+		if a.tty != nil {
+			a.dieWrap(a.tty.Close(), "closing terminal failed")
+		}
+	}()
+
+	a.dieWrap(validateTmpPattern(cli.TmpPattern), "invalid --tmp-pattern")
+
+	// warning about interrupted runs, since whatever they were doing has
+	// been left half done
+
+	if !strings.HasPrefix(ctx.Command(), "recover") {
+		ids, err := interruptedJournals()
+		if err != nil {
+			a.warn("finding interrupted runs failed: %s", err)
+		}
+		for _, id := range ids {
+			a.warn("run %s was interrupted, use `vimv2 recover %s` to finish "+
+				"it or roll it back", id, id)
+		}
+	}
+
+	switch ctx.Command() {
+	case "undo", "undo <id>":
+		a.undoRun(cli.Undo.ID)
+	case "recover", "recover <id>":
+		a.recoverRun(cli.Recover.ID, cli.Recover.Rollback)
+	default:
+		a.rename()
+	}
+}
+
+// an app holds what's shared by the parts of a single run of the program
+type app struct {
+	exitCode int
+	// stdinUsed is set if stdin is read for input, in which case the
+	// terminal is read from instead for prompts and by the editor
+	stdinUsed bool
+	tty       *os.File
+}
+
+func (a *app) warn(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "%s: ", os.Args[0])
+	fmt.Fprintf(os.Stderr, format, args...)
+	fmt.Fprintln(os.Stderr)
+}
+
+func (a *app) die(format string, args ...any) {
+	a.warn(format, args...)
+	a.exitCode = 1
+	// we use this instead of os.Exit so that we can run all cleanup that's
+	// been deferred up 'till this point
+	runtime.Goexit()
+}
+
+func (a *app) dieWrap(err error, format string, args ...any) {
+	if err == nil {
+		return
+	}
+
+	a.die(fmt.Sprintf("%s: %%s", format), append(args, err.Error())...)
+}
+
+// report reports how rolling back went if it had to happen, given the result
+// of executing ops for action, and exits with a status that reflects it if
+// anything failed
+func (a *app) report(err error, action string) {
+	var rbErr *rollbackError
+	if errors.As(err, &rbErr) {
+		a.warn("%s failed: %s", action, rbErr.err)
+		for _, f := range rbErr.failures {
+			a.warn("rolling back %s failed: %s", f.op, f.err)
+		}
+
+		// distinct exit codes let callers tell whether anything was left
+		// changed
+		if len(rbErr.failures) == 0 {
+			a.warn("all changes were rolled back")
+			a.exitCode = 2
+		} else {
+			a.warn("some changes couldn't be rolled back")
+			a.exitCode = 3
+		}
 		runtime.Goexit()
 	}
-	dieWrap := func(err error, format string, a ...any) {
-		if err == nil {
-			return
+	a.dieWrap(err, "%s failed", action)
+}
+
+// reportLeftovers warns about anything that's still at one of the temporary
+// names tmps within d
+func (a *app) reportLeftovers(d *dir, tmps []string) {
+	leftover, err := leftoverTmps(d, tmps)
+	if err != nil {
+		a.warn("checking for leftover temporary names failed: %s", err)
+	}
+	for _, tmp := range leftover {
+		a.warn("%q was left under a temporary name", tmp)
+	}
+}
+
+// keepJournal leaves the journal of a run that couldn't be recovered, so that
+// recovering it can be tried again
+func (a *app) keepJournal(w *journalWriter) {
+	a.dieWrap(w.keep(), "closing journal failed")
+	a.warn("run %s is still unfinished, use `vimv2 recover %s` to try again",
+		w.id, w.id)
+}
+
+// newExecutor returns an executor that performs ops within d
+func (a *app) newExecutor(d *dir, trash bool) executor {
+	x := executor{move: d.move, exchange: d.exchange, create: d.create,
+		remove: d.removeAll, uncreate: d.remove}
+	if trash {
+		var err error
+		x.trash, err = trashClosure(d, time.Now)
+		a.dieWrap(err, "finding trash failed")
+		x.restore = func(trashed, src string) error {
+			return untrash(d, trashed, src)
+		}
+	}
+
+	return x
+}
+
+// terminal returns what prompts and the editor should read from
+func (a *app) terminal() *os.File {
+	if !a.stdinUsed {
+		return os.Stdin
+	}
+	if a.tty == nil {
+		var err error
+		a.tty, err = openTerminal()
+		a.dieWrap(err, "opening terminal failed")
+	}
+
+	return a.tty
+}
+
+// readChoice prints prompt, then reads a single byte from the terminal in raw
+// mode so that no enter is required
+func (a *app) readChoice(prompt string) byte {
+	fmt.Fprint(os.Stderr, prompt)
+
+	var b [1]byte
+	var err error
+	if term.IsTerminal(int(os.Stderr.Fd())) {
+		oldState, rawErr := term.MakeRaw(int(os.Stderr.Fd()))
+		a.dieWrap(rawErr, "failed to set terminal to raw mode")
+		_, err = a.terminal().Read(b[:])
+		a.dieWrap(term.Restore(int(os.Stderr.Fd()), oldState),
+			"failed to restore terminal state")
+	} else {
+		_, err = a.terminal().Read(b[:])
+		if err == io.EOF {
+			fmt.Fprintln(os.Stderr)
+			a.die("user exited")
+		}
+	}
+
+	// print char (would be nice to just use terminal echo, but that's not an
+	// option with x/term), and print newline so things show up on the next
+	// line
+	fmt.Fprintf(os.Stderr, "%c\n", b[0])
+
+	// handle the read error
+	a.dieWrap(err, "failed to read from stderr")
+
+	return b[0]
+}
+
+// undoRun undoes the run with the given ID, or the most recent one that
+// hasn't been undone if it's empty, which doesn't involve the editor at all.
+func (a *app) undoRun(id string) {
+	if id == "" {
+		var err error
+		id, err = latestJournal()
+		a.dieWrap(err, "finding journal failed")
+	}
+	j, err := readJournal(id)
+	a.dieWrap(err, "reading journal failed")
+
+	d, err := openDir(j.Dir)
+	a.dieWrap(err, "opening directory failed")
+	defer func() { a.dieWrap(d.Close(), "closing directory failed") }()
+
+	now := time.Now()
+	t := &tmpNamer{pattern: cli.TmpPattern,
+		session: now.Format(journalIDLayout)}
+	ops, err := undoOps(d, j, t)
+	a.dieWrap(err, "undoing %s failed", id)
+	x := a.newExecutor(d, false)
+	w, err := createJournal(journal{Dir: j.Dir, Time: now,
+		Undoes: id, Ops: ops, Tmps: t.names})
+	a.dieWrap(err, "creating journal failed")
+	x.log = w.logger(d)
+	d.copyTmp, d.copied = w.copyTmps(t), w.logCopied
+
+	err = execute(ops, 0, x)
+	if err == nil {
+		// the journal is removed so that the next undo goes further back
+		a.dieWrap(removeJournal(id), "removing journal failed")
+	}
+	a.dieWrap(w.finish(), "finishing journal failed")
+	a.reportLeftovers(d, t.names)
+	a.report(err, "undoing")
+}
+
+// recoverRun finishes the interrupted run with the given ID, or the most
+// recent one if it's empty, using its journal, or rolls it back if rollingBack
+// is set.
+func (a *app) recoverRun(id string, rollingBack bool) {
+	if id == "" {
+		ids, err := interruptedJournals()
+		a.dieWrap(err, "finding interrupted runs failed")
+		if len(ids) == 0 {
+			a.die("no interrupted runs found")
+		}
+		id = ids[len(ids)-1]
+	}
+	w, err := openJournal(id)
+	a.dieWrap(err, "opening journal failed")
+
+	d, err := openDir(w.Dir)
+	a.dieWrap(err, "opening directory failed")
+	defer func() { a.dieWrap(d.Close(), "closing directory failed") }()
+
+	// copies are named for this session, so that they can't clash with names
+	// the run planned to use
+	d.copyTmp = w.copyTmps(&tmpNamer{pattern: cli.TmpPattern,
+		session: time.Now().Format(journalIDLayout),
+		taken:   takenIn[string, string](nil, nil, d)})
+	d.copied = w.logCopied
+
+	// the op after the last one that was logged may have been performed
+	// anyway
+	a.dieWrap(w.reconcile(d), "checking journal failed")
+
+	trash := false
+	for _, o := range w.Ops {
+		trash = trash || o.kind == opTrash
+	}
+	x := a.newExecutor(d, trash)
+	x.log = w.logger(d)
+	x.trashed = w.trashed
+
+	if rollingBack || w.rollingBack {
+		if !rollingBack {
+			a.warn("run %s failed part way through, so it's being rolled "+
+				"back", id)
+		}
+
+		failures := rollback(w.Ops, w.performed, x)
+		if len(failures) == 0 {
+			a.dieWrap(w.finish(), "finishing journal failed")
+		} else {
+			a.keepJournal(w)
+		}
+		a.reportLeftovers(d, append(w.Tmps, w.copies...))
+		for _, f := range failures {
+			a.warn("rolling back %s failed: %s", f.op, f.err)
+		}
+		if len(failures) > 0 {
+			a.warn("some changes couldn't be rolled back")
+			a.exitCode = 3
+		}
+		return
+	}
+
+	start := 0
+	for start < len(w.Ops) && w.performed[start] {
+		start++
+	}
+	err = execute(w.Ops, start, x)
+	if err == nil && w.Undoes != "" {
+		err = removeJournal(w.Undoes)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		a.dieWrap(err, "removing journal failed")
+	}
+	if err == nil {
+		a.dieWrap(w.finish(), "finishing journal failed")
+	} else {
+		a.keepJournal(w)
+	}
+	a.reportLeftovers(d, append(w.Tmps, w.copies...))
+	a.report(err, "recovering")
+}
+
+// a renaming is what the rename command is working on
+type renaming struct {
+	*app
+	d *dir
+	// root is the absolute path of d
+	root string
+	// selected is nil unless paths were given, in which case they're the
+	// only things renamed
+	selected []string
+	// maxDepth is how deep things are listed within d, as for listEntries
+	maxDepth int
+	// generate, if set, generates destinations instead of, or before, they're
+	// edited, and generated is set if they're used without editing
+	generate  func(srcs []string) (edit, error)
+	generated bool
+	// editor is the editor command, if editorFound is set
+	editor      string
+	editorFound bool
+}
+
+// rename renames things in a directory, or those that were given, which is
+// what the program does by default.
+func (a *app) rename() {
+	subs := make([]substitution, len(cli.Rename.Expression))
+	for i, expr := range cli.Rename.Expression {
+		var err error
+		subs[i], err = parseSubstitution(expr)
+		a.dieWrap(err, "invalid expression %q", expr)
+	}
+
+	var tmpl template
+	if cli.Rename.Template != "" {
+		var err error
+		tmpl, err = parseTemplate(cli.Rename.Template)
+		a.dieWrap(err, "invalid --template")
+	}
+
+	var m *mapping
+	if cli.Rename.From != "" {
+		f := os.Stdin
+		a.stdinUsed = cli.Rename.From == "-"
+		if !a.stdinUsed {
+			var err error
+			f, err = os.Open(cli.Rename.From)
+			a.dieWrap(err, "opening --from failed")
+		}
+
+		from, err := readMapping(f,
+			mappingFormat(cli.Rename.FromFormat, cli.Rename.From))
+		a.dieWrap(err, "reading --from failed")
+		if f != os.Stdin {
+			a.dieWrap(f.Close(), "closing --from failed")
+		}
+		m = &from
+	}
+
+	root, selected := a.selectPaths()
+
+	// detecting editor, which isn't needed for expressions, templates, or
+	// mappings unless their results are being edited, and is only needed with a
+	// filter if the filter's output is invalid
+
+	rn := &renaming{app: a, root: root, selected: selected}
+	rn.editor, rn.editorFound = cli.Rename.Editor, cli.Rename.Editor != ""
+	if !rn.editorFound {
+		rn.editor, rn.editorFound = os.LookupEnv("EDITOR")
+	}
+	if !rn.editorFound {
+		rn.editor, rn.editorFound = os.LookupEnv("VISUAL")
+	}
+	needsEditor := cli.Rename.Edit || (len(subs) == 0 &&
+		cli.Rename.Filter == "" && cli.Rename.Template == "" && m == nil)
+	if !rn.editorFound && needsEditor {
+		a.die("no editor found, please set $EDITOR or $VISUAL")
+	}
+
+	// opening the directory, all further filesystem operations are performed
+	// relative to this handle so that the directory can't be swapped out from
+	// under us
+
+	var err error
+	rn.d, err = openDir(root)
+	a.dieWrap(err, "opening directory failed")
+	defer func() { a.dieWrap(rn.d.Close(), "closing directory failed") }()
+
+	if selected != nil {
+		missing := false
+		for _, src := range selected {
+			_, err := rn.d.lstat(src)
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+				a.warn("%q doesn't exist", src)
+				missing = true
+			} else {
+				a.dieWrap(err, "checking %q failed", src)
+			}
+		}
+		if missing {
+			a.die("some paths don't exist")
+		}
+	}
+
+	rn.generate = rn.generator(subs, tmpl, m)
+	rn.generated = rn.generate != nil && !cli.Rename.Edit
+
+	rn.maxDepth = 1
+	if cli.Rename.MaxDepth > 0 {
+		rn.maxDepth = cli.Rename.MaxDepth
+	} else if cli.Rename.Recursive {
+		rn.maxDepth = 0
+	}
+
+	r := rn.edit()
+
+	// planning, where scripts can't exchange things, so they always use
+	// temporary locations, and temporary names are unique to this run, which
+	// is identified by when it started
+
+	now := time.Now()
+	t := &tmpNamer{pattern: cli.TmpPattern,
+		session: now.Format(journalIDLayout)}
+	ops, err := planOps(rn.d, r, cli.Rename.Trash, cli.Rename.Script == "", t)
+	a.dieWrap(err, "planning failed")
+
+	// printing what would've been done, in the order it would've been done,
+	// either for humans or as a script
+
+	if cli.Rename.DryRun {
+		for _, o := range ops {
+			fmt.Println(o)
 		}
+		return
+	}
 
-		die(fmt.Sprintf("%s: %%s", format), append(a, err.Error())...)
+	if cli.Rename.Script != "" {
+		script := os.Stdout
+		if cli.Rename.Script != "-" {
+			script, err = os.OpenFile(cli.Rename.Script,
+				os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o777)
+			a.dieWrap(err, "creating script failed")
+			defer func() { a.dieWrap(script.Close(), "closing script failed") }()
+		}
+		a.dieWrap(writeScript(script, root, ops), "writing script failed")
+		return
 	}
 
-	// detecting editor
+	if len(ops) == 0 {
+		return
+	}
+	a.perform(rn.d, root, now, ops, t, cli.Rename.Trash)
+}
 
-	editor, editorFound := os.LookupEnv("EDITOR")
-	if !editorFound {
-		editor, editorFound = os.LookupEnv("VISUAL")
+// selectPaths chooses what to rename, which is everything in a directory, or
+// only the paths that were given, which are renamed within the deepest
+// directory that contains them all. It returns the absolute path of that
+// directory, and the paths within it that were selected, or nil if everything
+// in it is.
+func (a *app) selectPaths() (root string, selected []string) {
+	paths := cli.Rename.Paths
+
+	readsStdin := false
+	for _, p := range paths {
+		readsStdin = readsStdin || p == "-"
 	}
-	if !editorFound {
-		die("no editor found, please set $EDITOR or $VISUAL")
+	if cli.Rename.Null && !readsStdin {
+		a.die("-0 only applies to paths read from stdin with -")
 	}
 
-	// toctou is inevitable, we assume that nobody touches the files from the
-	// time we read them until we exit
+	root = "."
+	byPath := len(paths) > 1
+	if len(paths) == 1 {
+		info, err := os.Stat(paths[0])
+		byPath = paths[0] == "-" || err != nil || !info.IsDir()
+		if !byPath {
+			root = paths[0]
+		}
+	}
+
+	if byPath {
+		if cli.Rename.Recursive || cli.Rename.MaxDepth > 0 {
+			a.die("--recursive and --max-depth can't be used with paths")
+		}
 
-	// reading srcs
+		var given []string
+		for _, p := range paths {
+			if p != "-" {
+				given = append(given, p)
+				continue
+			}
 
-	entries, err := os.ReadDir(cli.Directory)
-	dieWrap(err, "reading directory failed")
+			if a.stdinUsed {
+				a.die("stdin can only be read once")
+			}
+			a.stdinUsed = true
+			read, err := readPaths(os.Stdin, cli.Rename.Null)
+			a.dieWrap(err, "reading paths from stdin failed")
+			given = append(given, read...)
+		}
+		if len(given) == 0 {
+			a.die("no paths were given")
+		}
 
-	srcs := make([]string, len(entries))
-	for i, entry := range entries {
-		srcs[i] = entry.Name()
+		for i, p := range given {
+			var err error
+			given[i], err = filepath.Abs(p)
+			a.dieWrap(err, "finding %q failed", p)
+		}
+		var err error
+		root, selected, err = commonRoot(given)
+		a.dieWrap(err, "invalid paths")
 	}
+	root, err := filepath.Abs(root)
+	a.dieWrap(err, "finding directory failed")
+
+	return root, selected
+}
+
+// generator returns a function that generates destinations from subs, tmpl,
+// or m, whichever is set, or nil if none are.
+func (rn *renaming) generator(subs []substitution, tmpl template, m *mapping) func(srcs []string) (edit, error) {
+	if len(subs) > 0 {
+		return func(srcs []string) (edit, error) {
+			return substitute(srcs, subs), nil
+		}
+	}
+	if tmpl != nil {
+		return func(srcs []string) (edit, error) {
+			return applyTemplate(rn.d, tmpl, srcs, filepath.Base(rn.root))
+		}
+	}
+	if m != nil {
+		return func(srcs []string) (edit, error) {
+			e, missing := m.edit(srcs)
+			for _, src := range missing {
+				_, err := rn.d.lstat(src)
+				if err == nil && rn.selected != nil {
+					rn.warn("%q wasn't given", src)
+				} else if err == nil {
+					rn.warn("%q isn't listed, see --recursive and --max-depth",
+						src)
+				} else if errors.Is(err, fs.ErrNotExist) ||
+					errors.Is(err, syscall.ENOTDIR) {
+					rn.warn("%q doesn't exist", src)
+				} else {
+					rn.warn("checking %q failed: %s", src, err)
+				}
+			}
+			if len(missing) > 0 {
+				rn.die("some sources can't be renamed")
+			}
+
+			return e, nil
+		}
+	}
+
+	return nil
+}
+
+// list returns what's being renamed as it is now.
+func (rn *renaming) list() ([]string, error) {
+	if rn.selected == nil {
+		return listEntries(rn.d, rn.maxDepth)
+	}
+
+	// paths that have been removed since they were given are dropped
+	ids, err := snapshotExisting(rn.d, rn.selected)
+	if err != nil {
+		return nil, err
+	}
+	var srcs []string
+	for i, id := range ids {
+		if id != nil {
+			srcs = append(srcs, rn.selected[i])
+		}
+	}
+
+	return srcs, nil
+}
+
+// edit lists what's being renamed, and has it edited, or generates
+// destinations for it, until the result is valid, then returns what the
+// result asks to be done.
+func (rn *renaming) edit() request {
+	srcs, err := rn.list()
+	rn.dieWrap(err, "reading directory failed")
+
+	// others may change the directory while it's being edited, so we
+	// remember what was there to check that it's still there before we change
+	// anything
+	ids, err := snapshot(rn.d, srcs)
+	rn.dieWrap(err, "reading directory failed")
 
 	// variable setup for the loop below
 	tmpfile := (*os.File)(nil)
+	filterPending := cli.Rename.Filter != ""
 	tmpfileCreated, tmpfileClosed := false, false
 
 	defer func() {
 		// cleans up the last remaining tmpfile, if one exists
 		if tmpfileCreated {
 			if !tmpfileClosed {
-				dieWrap(tmpfile.Close(), "closing tmpfile failed")
+				rn.dieWrap(tmpfile.Close(), "closing tmpfile failed")
 			}
-			dieWrap(os.Remove(tmpfile.Name()), "removing tmpfile failed")
+			rn.dieWrap(os.Remove(tmpfile.Name()), "removing tmpfile failed")
 		}
 	}()
 
-	// maps for moving things
-	var srcToDst map[string]string
-	var dstSet map[string]struct{}
-
 	// main input loop which continues until the user enters valid input or
 	// exits intentionally
 
 	for {
-		// creating next tmpfile, if necessary
+		// indicates we exited the loop manually
+		inputInvalid := false
+
+		// errors are written to the buffer as well, above the lines they're
+		// about, so they can be seen while it's edited again
+		notes := map[int][]string{}
+		note := func(line int, format string, a ...any) {
+			msg := fmt.Sprintf(format, a...)
+			rn.warn("%s", msg)
+			notes[line] = append(notes[line], msg)
+			inputInvalid = true
+		}
 
-		if tmpfile == nil {
-			tmpfile, err = os.CreateTemp("", "vimv2")
-			dieWrap(err, "creating tmpfile failed")
-			tmpfileCreated = true
+		var e edit
+		if rn.generated {
+			e, err = rn.generate(srcs)
+			rn.dieWrap(err, "generating destinations failed")
+		} else {
+			// creating next tmpfile, if necessary
+
+			if tmpfile == nil {
+				tmpfile, err = os.CreateTemp("", "vimv2")
+				rn.dieWrap(err, "creating tmpfile failed")
+				tmpfileCreated = true
+
+				initial := edit{dsts: srcs}
+				if rn.generate != nil {
+					initial, err = rn.generate(srcs)
+					rn.dieWrap(err, "generating destinations failed")
+				}
+				rn.dieWrap(writeBuffer(tmpfile, initial, cli.Rename.Numbered),
+					"writing to tmpfile failed")
 
-			for _, src := range srcs {
-				_, err := tmpfile.Write([]byte(src))
-				dieWrap(err, "writing to tmpfile failed")
-				_, err = tmpfile.Write([]byte{byte('\n')})
-				dieWrap(err, "writing to tmpfile failed")
+				rn.dieWrap(tmpfile.Close(), "closing tmpfile failed")
+				tmpfileClosed = true
 			}
 
-			dieWrap(tmpfile.Close(), "closing tmpfile failed")
-			tmpfileClosed = true
-		}
+			runEditor := true
+			if filterPending {
+				// running filter, which replaces the buffer with its output,
+				// and is only run once, so that the editor can be used to fix
+				// what it did
+
+				filterPending = false
+				runEditor = cli.Rename.Edit
+
+				cmd, err := filterCommand(cli.Rename.Filter)
+				rn.dieWrap(err, "parsing filter command failed")
+				in, err := os.Open(tmpfile.Name())
+				rn.dieWrap(err, "reading tmpfile failed")
+				cmd.Stdin = in
+				cmd.Stderr = os.Stderr
+
+				out, err := cmd.Output()
+				rn.dieWrap(in.Close(), "closing tmpfile failed")
+				rn.dieWrap(err, "running filter command failed")
+				rn.dieWrap(os.WriteFile(tmpfile.Name(), out, 0o600),
+					"writing to tmpfile failed")
+			}
+			if runEditor {
+				// running editor
 
-		// running editor
+				if !rn.editorFound {
+					rn.die("no editor found, please set $EDITOR or $VISUAL")
+				}
 
-		cmd := exec.Command(editor, tmpfile.Name())
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+				cmd, err := editorCommand(rn.editor, tmpfile.Name())
+				rn.dieWrap(err, "parsing editor command failed")
+				cmd.Stdin = rn.terminal()
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
 
-		dieWrap(cmd.Run(), "running editor command failed")
+				rn.dieWrap(cmd.Run(), "running editor command failed")
+			}
 
-		// reading the result of the edit, and validating as we go
+			// reading the result of the edit
 
-		// intialize maps
-		srcToDst = map[string]string{}
-		dstSet = map[string]struct{}{}
+			tmpfile, err = os.OpenFile(tmpfile.Name(), os.O_RDWR, 0)
+			rn.dieWrap(err, "reopening tmpfile failed")
+			tmpfileClosed = false
 
-		tmpfile, err = os.OpenFile(tmpfile.Name(), os.O_RDWR, 0)
-		dieWrap(err, "reopening tmpfile failed")
-		tmpfileClosed = false
-		scanner := bufio.NewScanner(tmpfile)
+			e, err = readBuffer(tmpfile, srcs, cli.Rename.Numbered)
+			var bufErr *bufferError
+			if errors.As(err, &bufErr) {
+				rn.warn("%s", bufErr)
+				notes[bufErr.line] = append(notes[bufErr.line], bufErr.msg)
+				inputInvalid = true
+			} else {
+				rn.dieWrap(err, "reading tmpfile failed")
+			}
+		}
 
-		// indicates we exited the loop manually
-		inputInvalid := false
+		// validating the result, and checking everything that could
+		// otherwise fail part way through, and reporting all of it at once,
+		// so it can be fixed in one go
 
-		for scanner.Scan() {
-			if len(dstSet) >= len(srcs) {
-				warn("tmpfile contains too many lines")
-				inputInvalid = true
-				break
+		var r request
+		// nothing's listed completely when paths are given
+		listed := map[string]struct{}{}
+		if rn.selected == nil {
+			listed = listedDirs(srcs, ids, rn.maxDepth)
+		}
+		if !inputInvalid {
+			var problems []problem
+			r, problems = interpretEdit(rn.d, srcs, e)
+			if len(problems) == 0 {
+				problems, err = preflight(rn.d, srcs, listed, r.srcToDst,
+					r.written, r.creates, r.deleted)
+				rn.dieWrap(err, "validating destinations failed")
 			}
 
-			dst := scanner.Text()
-			_, found := dstSet[dst]
-			if found {
-				warn("duplicate destination \"%s\"", dst)
-				inputInvalid = true
-				break
+			for _, p := range problems {
+				note(r.line(p), "%s", p)
 			}
-			srcToDst[srcs[len(dstSet)]] = dst
-			dstSet[dst] = struct{}{}
 		}
-		// if this is set, we don't need to check this because we already have
-		// an error that we're going to warn about
-		if !inputInvalid {
-			dieWrap(scanner.Err(), "reading tmpfile failed")
 
-			if len(dstSet) == len(srcs) {
-				// everything's ok, so we can continue to moving
-				break
+		// nothing's actually deleted in a dry run, or when writing a script,
+		// so there's no need to confirm anything
+		if !inputInvalid && len(r.toDelete) > 0 && !cli.Rename.DryRun &&
+			cli.Rename.Script == "" {
+			verb := "delete"
+			if cli.Rename.Trash {
+				verb = "trash"
+			}
+			for _, src := range r.toDelete {
+				fmt.Fprintf(os.Stderr, "%s %q\n", verb, src)
 			}
 
-			// it can't contain too many because that would've caused an error
-			// above, steting inputInvalid
-			warn("tmpfile contains too few lines")
+		CONFIRM:
+			for {
+				b := rn.readChoice("confirm deletion? [\033[1;31my\033[0mes/" +
+					"\033[1;31mn\033[0mo]: ")
+
+				switch b {
+				case 'y', 'Y':
+					break CONFIRM
+				case 'n', 'N':
+					inputInvalid = true
+					break CONFIRM
+				case 3 /* ^C */, 4 /* ^D */, 'q', 'Q':
+					rn.die("user exited")
+				default:
+					rn.warn("invalid selection '%c'", b)
+				}
+			}
 		}
 
-	PROMPT:
-		for {
-			// print prompt
-			fmt.Fprintf(os.Stderr, "[\033[1;31me\033[0mdit "+
-				"existing/edit \033[1;31mn\033[0mew/\033[1;31mq\033[0muit]: ")
+		// checking that nothing's changed since the directory was listed, in
+		// which case the edit may no longer make sense, and what was edited
+		// could be clobbered
+		if !inputInvalid {
+			// things that appear where nothing was listed wouldn't be
+			// listed after refreshing either, so those are left to
+			// preflight
+			listedDsts := map[string]struct{}{}
+			for dst := range r.dstSet {
+				_, found := listed[path.Dir(dst)]
+				if found {
+					listedDsts[dst] = struct{}{}
+				}
+			}
 
-			// read 1 byte in raw mode so no enter is required
-			var b [1]byte
-			if term.IsTerminal(int(os.Stderr.Fd())) {
-				oldState, err := term.MakeRaw(int(os.Stderr.Fd()))
-				dieWrap(err, "failed to set terminal to raw mode")
-				_, err = os.Stdin.Read(b[:])
-				dieWrap(term.Restore(int(os.Stderr.Fd()), oldState),
-					"failed to restore terminal state")
-			} else {
-				_, err = os.Stdin.Read(b[:])
-				if err == io.EOF {
-					fmt.Fprintln(os.Stderr)
-					die("user exited")
+			changes, err := findChanges(rn.d, srcs, ids, listedDsts)
+			rn.dieWrap(err, "checking for changes failed")
+
+			if len(changes) > 0 {
+				for _, c := range changes {
+					rn.warn("%s", c)
+				}
+				if rn.generated {
+					rn.die("directory changed since it was listed")
+				}
+
+			REFRESH:
+				for {
+					b := rn.readChoice("directory changed, [\033[1;31mr\033[0mefresh/" +
+						"\033[1;31mq\033[0muit]: ")
+
+					switch b {
+					case 'r', 'R':
+						break REFRESH
+					case 3 /* ^C */, 4 /* ^D */, 'q', 'Q':
+						rn.die("user exited")
+					default:
+						rn.warn("invalid selection '%c'", b)
+					}
 				}
+
+				// the buffer is rewritten for the directory as it is now,
+				// keeping the edits to things that are still there
+				oldSrcs := srcs
+				srcs, err = rn.list()
+				rn.dieWrap(err, "reading directory failed")
+				ids, err = snapshot(rn.d, srcs)
+				rn.dieWrap(err, "reading directory failed")
+
+				rn.dieWrap(tmpfile.Truncate(0), "writing to tmpfile failed")
+				_, err = tmpfile.Seek(0, io.SeekStart)
+				rn.dieWrap(err, "writing to tmpfile failed")
+				rn.dieWrap(writeBuffer(tmpfile, refreshEdit(oldSrcs, e, srcs),
+					cli.Rename.Numbered), "writing to tmpfile failed")
+				rn.dieWrap(tmpfile.Close(), "closing tmpfile failed")
+				tmpfileClosed = true
+				continue
 			}
+		}
 
-			// print char (would be nice to just use terminal echo, but that's
-			// not an option with x/term), and print newline so things show up
-			// on the next line
-			fmt.Fprintf(os.Stderr, "%c\n", b[0])
+		if !inputInvalid {
+			// everything's ok, so we can continue to moving
+			return r
+		}
+
+		// there's nothing to edit to fix generated destinations
+		if rn.generated {
+			rn.die("generated destinations are invalid")
+		}
 
-			// handle the read error
-			dieWrap(err, "failed to read from stderr")
+		// the buffer is rewritten with the errors in it, replacing any that
+		// were there from before, in case it's edited again
+		_, err = tmpfile.Seek(0, io.SeekStart)
+		rn.dieWrap(err, "reading tmpfile failed")
+		var annotated bytes.Buffer
+		rn.dieWrap(annotate(tmpfile, &annotated, notes),
+			"reading tmpfile failed")
+		rn.dieWrap(tmpfile.Truncate(0), "writing to tmpfile failed")
+		_, err = tmpfile.Seek(0, io.SeekStart)
+		rn.dieWrap(err, "writing to tmpfile failed")
+		_, err = annotated.WriteTo(tmpfile)
+		rn.dieWrap(err, "writing to tmpfile failed")
+
+	PROMPT:
+		for {
+			b := rn.readChoice("[\033[1;31me\033[0mdit " +
+				"existing/edit \033[1;31mn\033[0mew/\033[1;31mq\033[0muit]: ")
 
 			// proceed according to user input
-			switch b[0] {
+			switch b {
 			case 'n', 'N':
-				dieWrap(tmpfile.Close(), "closing tmpfile failed")
-				dieWrap(os.Remove(tmpfile.Name()), "removing tmpfile failed")
+				rn.dieWrap(tmpfile.Close(), "closing tmpfile failed")
+				rn.dieWrap(os.Remove(tmpfile.Name()), "removing tmpfile failed")
 				tmpfile = nil
 				fallthrough
 			case 'e', 'E':
 				break PROMPT
 			case 3 /* ^C */, 4 /* ^D */, 'q', 'Q':
-				die("user exited")
+				rn.die("user exited")
 			default:
-				warn("invalid selection '%c'", b[0])
+				rn.warn("invalid selection '%c'", b)
 			}
 		}
 	}
+}
 
-	// movement
-
-	dieWrap(moveAll(srcToDst, os.Rename, tmpClosure(srcToDst, dstSet)),
-		"renaming failed")
-	runtime.Goexit()
+// perform performs ops within d, whose absolute path is root, for the run
+// that started at now, where t provided the temporary names that ops use.
+// It's journaled so that it can be recovered if it's interrupted, and undone
+// later, and it's rolled back if anything fails part way through.
+func (a *app) perform(d *dir, root string, now time.Time, ops []op, t *tmpNamer, trash bool) {
+	x := a.newExecutor(d, trash)
+	w, err := createJournal(journal{Dir: root, Time: now, Ops: ops,
+		Tmps: t.names})
+	a.dieWrap(err, "creating journal failed")
+	x.log = w.logger(d)
+	d.copyTmp, d.copied = w.copyTmps(t), w.logCopied
+
+	err = execute(ops, 0, x)
+	a.dieWrap(w.finish(), "finishing journal failed")
+	a.reportLeftovers(d, t.names)
+	a.report(err, "renaming")
 }
@@ -5,17 +5,23 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"testing"
+	"time"
 )
 
 const prompt = "[\033[1;31me\033[0mdit existing/edit " +
 	"\033[1;31mn\033[0mew/\033[1;31mq\033[0muit]: "
 
+const deletePrompt = "confirm deletion? [\033[1;31my\033[0mes/" +
+	"\033[1;31mn\033[0mo]: "
+
 func Test_main(t *testing.T) {
 	// assumes the tests are run from the root of the repository
 	cwd, err := os.Getwd()
@@ -23,57 +29,1359 @@ func Test_main(t *testing.T) {
 	// restore cwd, since subtests will change it
 	t.Cleanup(func() { requireNoError(t, os.Chdir(cwd)) })
 
-	mockEditorPath := filepath.Join(cwd, "testdata", "mockeditor")
-	if runtime.GOOS == "windows" {
-		mockEditorPath += ".exe"
-	}
+	mockEditorPath := filepath.Join(cwd, "testdata", "mockeditor")
+	if runtime.GOOS == "windows" {
+		mockEditorPath += ".exe"
+	}
+
+	t.Log(mockEditorPath)
+
+	// generate the mock editor if it doesn't already exist
+	_, err = os.Stat(mockEditorPath)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		requireNoError(t, exec.Command("go", "generate").Run())
+	} else {
+		requireNoError(t, err)
+	}
+
+	nonExecutableEditorPath := filepath.Join(t.TempDir(), "nonexecutable")
+	requireNoError(t, os.WriteFile(nonExecutableEditorPath, nil, 0o644))
+
+	csvMappingPath := filepath.Join(t.TempDir(), "mapping.csv")
+	requireNoError(t, os.WriteFile(csvMappingPath,
+		[]byte("a,\"c, d\"\nb,$'e\\tf'\n"), 0o644))
+
+	tests := []struct {
+		description string
+
+		preTest      func(t *testing.T)
+		args         []string
+		stdin        string
+		createdFiles []string
+
+		expectedFiles                  []string
+		expectedStdout, expectedStderr string
+		// if set, this is matched instead of comparing with expectedStdout
+		expectedStdoutRegexp *regexp.Regexp
+		expectedExitCode     int
+	}{
+		{
+			description: "happy path simple",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `d file
+e file
+f file
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			createdFiles: []string{
+				"a file",
+				"b file",
+				"c file",
+			},
+			expectedFiles: []string{
+				"d file",
+				"e file",
+				"f file",
+			},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: "mock editor run 0\n",
+		},
+
+		{
+			description: "happy path other directory",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `b file
+a file
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args: []string{"sub"},
+			createdFiles: []string{
+				"a file",
+				"sub/a file",
+				"sub/b file",
+			},
+			expectedFiles: []string{
+				"a file",
+				"sub",
+				"sub/a file",
+				"sub/b file",
+			},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "happy path other directory, relative to cwd",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `c file
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args: []string{"sub/dir"},
+			createdFiles: []string{
+				"b file",
+				"sub/dir/b file",
+			},
+			expectedFiles: []string{
+				"b file",
+				"sub",
+				"sub/dir",
+				"sub/dir/c file",
+			},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: "mock editor run 0\n",
+		},
+
+		{
+			description: "recursive",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `other
+lib
+lib/baz.go
+src/foo.go
+src/foo.go/x
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args: []string{"-r"},
+			createdFiles: []string{
+				"other",
+				"src/bar.go",
+				"src/foo.go/x",
+			},
+			expectedFiles: []string{
+				"lib",
+				"lib/baz.go",
+				"lib/foo.go",
+				"lib/foo.go/x",
+				"other",
+			},
+			expectedStdout: `mock editor run 0
+[]
+other
+src
+src/bar.go
+src/foo.go
+src/foo.go/x
+`,
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "max depth",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `b
+b/c
+b/d
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args: []string{"--max-depth", "2"},
+			createdFiles: []string{
+				"a/c/e",
+				"a/d",
+			},
+			expectedFiles: []string{
+				"b",
+				"b/c",
+				"b/c/e",
+				"b/d",
+			},
+			expectedStdout: `mock editor run 0
+[]
+a
+a/c
+a/d
+`,
+			expectedStderr: "mock editor run 0\n",
+		},
+
+		{
+			description: "numbered, reordered and deleted",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `0003 b file
+
+0001 c file
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args:  []string{"-n"},
+			stdin: "?y",
+			createdFiles: []string{
+				"a file",
+				"b file",
+				"c file",
+			},
+			expectedFiles: []string{
+				"b file",
+				"c file",
+			},
+			expectedStdout: `mock editor run 0
+[]
+0001 a file
+0002 b file
+0003 c file
+`,
+			expectedStderr: `mock editor run 0
+delete "b file"
+` + deletePrompt + `?
+self: invalid selection '?'
+` + deletePrompt + `y
+`,
+		},
+		{
+			description: "numbered, deletion declined",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "0002 a file\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args:  []string{"-n"},
+			stdin: "nq",
+			createdFiles: []string{
+				"a file",
+				"b file",
+			},
+			expectedFiles: []string{
+				"a file",
+				"b file",
+			},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: `mock editor run 0
+delete "a file"
+` + deletePrompt + `n
+` + prompt + `q
+self: user exited
+`,
+			expectedExitCode: 1,
+		},
+		{
+			description: "numbered, deleted directory with unlisted contents",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "0001 a file\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args:  []string{"-n"},
+			stdin: "q",
+			createdFiles: []string{
+				"a file",
+				"d/x",
+			},
+			expectedFiles: []string{
+				"a file",
+				"d",
+				"d/x",
+			},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: `mock editor run 0
+self: cannot delete "d", since "d/x" wasn't listed
+` + prompt + `q
+self: user exited
+`,
+			expectedExitCode: 1,
+		},
+		{
+			description: "numbered, invalid lines",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "0001 a file\n0003 b file\n")
+				t.Setenv("MOCK_EDITOR_OUTPUT_1", "0001 a file\n0001 b file\n")
+				t.Setenv("MOCK_EDITOR_OUTPUT_2", "0001 a file\n0002 c file\nc file\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_1", "0")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_2", "0")
+			},
+			args:  []string{"-n"},
+			stdin: "eeq",
+			createdFiles: []string{
+				"a file",
+				"b file",
+			},
+			expectedFiles: []string{
+				"a file",
+				"b file",
+			},
+			expectedStdout: `mock editor run 0
+mock editor run 1
+mock editor run 2
+`,
+			expectedStderr: `mock editor run 0
+self: line 2: unknown number 0003
+` + prompt + `e
+mock editor run 1
+self: line 2: duplicate number 0001
+` + prompt + `e
+mock editor run 2
+self: duplicate destination "c file"
+` + prompt + `q
+self: user exited
+`,
+			expectedExitCode: 1,
+		},
+		{
+			description: "duplicate destinations written differently",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "x\n./x\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			stdin: "q",
+			createdFiles: []string{
+				"a",
+				"b",
+			},
+			expectedFiles: []string{
+				"a",
+				"b",
+			},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: `mock editor run 0
+self: duplicate destination "x"
+` + prompt + `q
+self: user exited
+`,
+			expectedExitCode: 1,
+		},
+		{
+			description: "numbered, created",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `0001 b/a
+0002 c
+a
+b/
+d/e/f/
+d/e/g
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args: []string{"-n"},
+			createdFiles: []string{
+				"a",
+				"b",
+			},
+			expectedFiles: []string{
+				"a",
+				"b",
+				"b/a",
+				"c",
+				"d",
+				"d/e",
+				"d/e/f",
+				"d/e/g",
+			},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "numbered, recursive deletion",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "0003 a/c\n")
+				t.Setenv("MOCK_EDITOR_OUTPUT_1", "0004 c\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_1", "0")
+			},
+			args:  []string{"-nr"},
+			stdin: "ny",
+			createdFiles: []string{
+				"a/b",
+				"a/c",
+				"c",
+			},
+			expectedFiles: []string{
+				"c",
+			},
+			expectedStdout: `mock editor run 0
+[]
+0001 a
+0002 a/b
+0003 a/c
+0004 c
+mock editor run 1
+[]
+0001 a
+0002 a/b
+0003 a/c
+0004 c
+`,
+			expectedStderr: `mock editor run 0
+self: cannot delete "a" without deleting "a/c"
+` + prompt + `n
+mock editor run 1
+delete "a"
+` + deletePrompt + `y
+`,
+		},
+
+		{
+			description: "numbered, trashed",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "0002 a file\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+				dataHome := t.TempDir()
+				t.Setenv("XDG_DATA_HOME", dataHome)
+				t.Cleanup(func() {
+					_, err := os.Stat(filepath.Join(dataHome, "Trash", "files",
+						"a file"))
+					requireNoError(t, err)
+				})
+			},
+			args:  []string{"-n", "--trash"},
+			stdin: "y",
+			createdFiles: []string{
+				"a file",
+				"b file",
+			},
+			expectedFiles: []string{
+				"a file",
+			},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: `mock editor run 0
+trash "a file"
+` + deletePrompt + `y
+`,
+		},
+
+		{
+			description: "quoted names",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `$'a\tfile'
+$'b\qfile'
+`)
+				t.Setenv("MOCK_EDITOR_OUTPUT_1", `$'a\tfile'
+$'b\nfile'
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_1", "0")
+			},
+			stdin: "e",
+			createdFiles: []string{
+				"a\nfile",
+				"b file",
+			},
+			expectedFiles: []string{
+				"a\tfile",
+				"b\nfile",
+			},
+			expectedStdout: `mock editor run 0
+[]
+$'a\nfile'
+b file
+mock editor run 1
+[]
+$'a\tfile'
+# error: invalid escape \q
+$'b\qfile'
+`,
+			expectedStderr: `mock editor run 0
+self: line 2: invalid escape \q
+` + prompt + `e
+mock editor run 1
+`,
+		},
+
+		{
+			description: "dry run",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `0001 c
+0002 e/d
+e/
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args: []string{"-n", "--dry-run"},
+			createdFiles: []string{
+				"b",
+				"d",
+				"z",
+			},
+			expectedFiles: []string{
+				"b",
+				"d",
+				"z",
+			},
+			expectedStdout: `mock editor run 0
+move "b" -> "c"
+mkdir "e"
+move "d" -> "e/d"
+delete "z"
+`,
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "dry run, deletions",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `0001 c
+0002 c/x
+0004 z
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args: []string{"-r", "-n", "--dry-run"},
+			createdFiles: []string{
+				"a/x",
+				"a/y",
+				"b",
+				"w",
+				"z",
+			},
+			expectedFiles: []string{
+				"a",
+				"a/x",
+				"a/y",
+				"b",
+				"w",
+				"z",
+			},
+			// only deletions of reused names and things in moved
+			// directories come first
+			expectedStdout: `mock editor run 0
+delete "a/y"
+delete "z"
+move "a" -> "c"
+move "b" -> "z"
+delete "w"
+`,
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "dry run cycle",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "b\na\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args: []string{"--dry-run"},
+			createdFiles: []string{
+				"a",
+				"b",
+			},
+			expectedFiles: []string{
+				"a",
+				"b",
+			},
+			// the cycle is broken by an exchange where that's atomic
+			expectedStdoutRegexp: regexp.MustCompile(`^mock editor run 0
+(move "(a|b)" -> "\.vimv2-[0-9]{8}-[0-9]{6}\.[0-9]{6}-1"
+move "(a|b)" -> "(a|b)"
+move "\.vimv2-[0-9]{8}-[0-9]{6}\.[0-9]{6}-1" -> "(a|b)"
+|exchange "(a|b)" <-> "(a|b)"
+)$`),
+			expectedStderr: "mock editor run 0\n",
+		},
+
+		{
+			description: "directory changed, refreshed",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "0001 c\n0002 d\nf\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+				t.Setenv("MOCK_EDITOR_CREATE_0", "c")
+				t.Setenv("MOCK_EDITOR_OUTPUT_1", "0001 e\n0002 d\n0003 c\nf\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_1", "0")
+			},
+			args:  []string{"-n"},
+			stdin: "r",
+			createdFiles: []string{
+				"a",
+				"b",
+			},
+			expectedFiles: []string{
+				"c",
+				"d",
+				"e",
+				"f",
+			},
+			expectedStdout: `mock editor run 0
+[]
+0001 a
+0002 b
+mock editor run 1
+[]
+0001 c
+0002 d
+0003 c
+f
+`,
+			expectedStderr: `mock editor run 0
+self: "c" already exists
+directory changed, [` + "\033[1;31mr\033[0mefresh/\033[1;31mq\033[0muit]: " + `r
+mock editor run 1
+`,
+		},
+
+		{
+			description: "rolled back",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				// z can't be moved beneath itself through l, which can only be
+				// found out by trying, after b has already been moved
+				requireNoError(t, os.Symlink("z", "l"))
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "c\nl\nl/z\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			createdFiles: []string{
+				"b",
+				"z/y",
+			},
+			expectedFiles: []string{
+				"b",
+				"l",
+				"z",
+				"z/y",
+			},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: `mock editor run 0
+self: renaming failed: renameat z l/z: invalid argument
+self: all changes were rolled back
+`,
+			expectedExitCode: 2,
+		},
+
+		{
+			description: "invalid destinations",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "\nn/b\nd\n")
+				t.Setenv("MOCK_EDITOR_OUTPUT_1", "a\nd/b\nd\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_1", "0")
+			},
+			stdin: "e",
+			createdFiles: []string{
+				"a",
+				"b",
+				"d/c",
+			},
+			expectedFiles: []string{
+				"a",
+				"d",
+				"d/b",
+				"d/c",
+			},
+			expectedStdout: `mock editor run 0
+[]
+a
+b
+d
+mock editor run 1
+[]
+# error: empty destination for "a"
+
+# error: parent directory of "n/b" won't exist
+n/b
+d
+`,
+			expectedStderr: `mock editor run 0
+self: empty destination for "a"
+self: parent directory of "n/b" won't exist
+` + prompt + `e
+mock editor run 1
+`,
+		},
+
+		{
+			description: "expressions",
+			args: []string{"-e", `s/^img_(\d+)/photo-$1/i`, "-e", "s/JPG/jpg/x",
+				"-e", "s/(.)/$1,/"},
+			createdFiles: []string{
+				"IMG_0001.jpg",
+				"IMG_0002.JPG",
+				"notes.txt",
+			},
+			expectedFiles: []string{
+				"p,hoto-0001.jpg",
+				"p,hoto-0002.jpg",
+				"n,otes.txt",
+			},
+		},
+		{
+			description: "expressions, invalid",
+			args:        []string{"-e", "s/a//", "-e", "s|b|n/b|"},
+			createdFiles: []string{
+				"a",
+				"b",
+			},
+			expectedFiles: []string{
+				"a",
+				"b",
+			},
+			expectedStderr: `self: empty destination for "a"
+self: parent directory of "n/b" won't exist
+self: generated destinations are invalid
+`,
+			expectedExitCode: 1,
+		},
+		{
+			description:   "expressions, unparseable",
+			args:          []string{"-e", "s/a/b"},
+			createdFiles:  []string{"a"},
+			expectedFiles: []string{"a"},
+			expectedStderr: `self: invalid expression "s/a/b": missing closing '/'
+`,
+			expectedExitCode: 1,
+		},
+
+		{
+			description: "template",
+			args:        []string{"--template", "{n:02}-{stem|lower}{ext}"},
+			createdFiles: []string{
+				"B.txt",
+				"a.TXT",
+			},
+			expectedFiles: []string{
+				"01-b.txt",
+				"02-a.TXT",
+			},
+		},
+		{
+			description: "template, edited",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "0001 x\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args:  []string{"-n", "-t", "{name}.bak", "--edit"},
+			stdin: "y",
+			createdFiles: []string{
+				"a",
+				"b",
+			},
+			expectedFiles: []string{
+				"x",
+			},
+			expectedStdout: `mock editor run 0
+[]
+0001 a.bak
+0002 b.bak
+`,
+			expectedStderr: `mock editor run 0
+delete "b"
+` + deletePrompt + `y
+`,
+		},
+		{
+			description:   "template, invalid",
+			args:          []string{"--template", "{n:0x}"},
+			createdFiles:  []string{"a"},
+			expectedFiles: []string{"a"},
+			expectedStderr: `self: invalid --template: invalid counter spec "0x"
+`,
+			expectedExitCode: 1,
+		},
+		{
+			description: "filter",
+			args:        []string{"--filter", "tr a-z A-Z"},
+			createdFiles: []string{
+				"a file",
+				"b file",
+			},
+			expectedFiles: []string{
+				"A FILE",
+				"B FILE",
+			},
+		},
+		{
+			description: "filter, invalid",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "c file\nb file\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args:  []string{"--filter", "sed 's/a/c/;1q'"},
+			stdin: "e",
+			createdFiles: []string{
+				"a file",
+				"b file",
+			},
+			expectedFiles: []string{
+				"b file",
+				"c file",
+			},
+			expectedStdout: `mock editor run 0
+[]
+# error: tmpfile contains too few lines
+c file
+`,
+			expectedStderr: `self: tmpfile contains too few lines
+` + prompt + `e
+mock editor run 0
+`,
+		},
+		{
+			description:  "filter, failed",
+			args:         []string{"--filter", "false"},
+			createdFiles: []string{"a"},
+			expectedFiles: []string{
+				"a",
+			},
+			expectedStderr: `self: running filter command failed: exit status 1
+`,
+			expectedExitCode: 1,
+		},
+
+		{
+			description: "paths",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "c\nb/c\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args: []string{"b/a", "./a", "b/a"},
+			createdFiles: []string{
+				"a",
+				"b/a",
+				"b/b",
+			},
+			expectedFiles: []string{
+				"b",
+				"b/b",
+				"b/c",
+				"c",
+			},
+			expectedStdout: `mock editor run 0
+[]
+a
+b/a
+`,
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "paths, stdin",
+			args:        []string{"-0", "-", "-e", "s/a/x/"},
+			stdin:       "b/a\x00a\nb\x00",
+			createdFiles: []string{
+				"a\nb",
+				"b/a",
+				"b/b",
+				"c",
+			},
+			expectedFiles: []string{
+				"b",
+				"b/b",
+				"b/x",
+				"c",
+				"x\nb",
+			},
+		},
+		{
+			description:  "paths, missing",
+			args:         []string{"a", "b/c", "-e", "s/a/x/"},
+			createdFiles: []string{"a"},
+			expectedFiles: []string{
+				"a",
+			},
+			expectedStderr: `self: "b/c" doesn't exist
+self: some paths don't exist
+`,
+			expectedExitCode: 1,
+		},
+		{
+			description:   "paths, recursive",
+			args:          []string{"-r", "a", "b"},
+			createdFiles:  []string{"a", "b"},
+			expectedFiles: []string{"a", "b"},
+			expectedStderr: `self: --recursive and --max-depth can't be used with paths
+`,
+			expectedExitCode: 1,
+		},
+
+		{
+			description: "from",
+			args:        []string{"--from", "-"},
+			stdin:       "a\tb\nb\ta\n\n./c\t$'d\\ne'\n",
+			createdFiles: []string{
+				"a",
+				"b",
+				"c",
+				"f",
+			},
+			expectedFiles: []string{
+				"a",
+				"b",
+				"d\ne",
+				"f",
+			},
+		},
+		{
+			description: "from, csv",
+			args:        []string{"--from", csvMappingPath},
+			createdFiles: []string{
+				"a",
+				"b",
+			},
+			expectedFiles: []string{
+				"c, d",
+				"e\tf",
+			},
+		},
+		{
+			description: "from, missing",
+			args:        []string{"--from", "-"},
+			stdin:       "a\tb\nc\td\nsub/x\ty\n",
+			createdFiles: []string{
+				"a",
+				"sub/x",
+			},
+			expectedFiles: []string{
+				"a",
+				"sub",
+				"sub/x",
+			},
+			expectedStderr: `self: "c" doesn't exist
+self: "sub/x" isn't listed, see --recursive and --max-depth
+self: some sources can't be renamed
+`,
+			expectedExitCode: 1,
+		},
+		{
+			description:   "from, unparseable",
+			args:          []string{"--from", "-"},
+			stdin:         "a\tb\na\tc\n",
+			createdFiles:  []string{"a"},
+			expectedFiles: []string{"a"},
+			expectedStderr: `self: reading --from failed: line 2: duplicate source "a"
+`,
+			expectedExitCode: 1,
+		},
 
-	t.Log(mockEditorPath)
+		{
+			description: "undo latest",
+			preTest: func(t *testing.T) {
+				dir, err := os.Getwd()
+				requireNoError(t, err)
+				writeJournal(t, journal{Dir: dir,
+					Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Ops:  []op{{kind: opMove, src: "x", dst: "y"}}}, 1, true)
+				writeJournal(t, journal{Dir: dir,
+					Time: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC),
+					Ops: []op{
+						{kind: opRemove, src: "z"},
+						{kind: opMove, src: "a", dst: "a.tmp1"},
+						{kind: opMove, src: "b", dst: "a"},
+						{kind: opMove, src: "a.tmp1", dst: "b"},
+						{kind: opMove, src: "c", dst: "d/c"},
+						{kind: opMkdir, dst: "e"},
+					}}, 6, true)
+			},
+			args: []string{"undo"},
+			createdFiles: []string{
+				"a",
+				"b",
+				"d/c",
+				"e/f",
+				"y",
+			},
+			expectedFiles: []string{
+				"a",
+				"b",
+				"c",
+				"d",
+				"e",
+				"e/f",
+				"y",
+			},
+		},
+		{
+			description: "undo recursive",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", `b
+b/x
+b/y
+a
+b/x2
+a/y
+c
+c/z2
+`)
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
 
-	// generate the mock editor if it doesn't already exist
-	_, err = os.Stat(mockEditorPath)
-	if err != nil && errors.Is(err, os.ErrNotExist) {
-		requireNoError(t, exec.Command("go", "generate").Run())
-	} else {
-		requireNoError(t, err)
-	}
+				args := os.Args
+				os.Args = []string{"self", "-r"}
+				redirectRecover(t, main, "")
+				os.Args = args
+			},
+			args: []string{"undo"},
+			createdFiles: []string{
+				"a/x",
+				"a/y",
+				"b/x",
+				"b/y",
+				"d/z",
+			},
+			expectedFiles: []string{
+				"a",
+				"a/x",
+				"a/y",
+				"b",
+				"b/x",
+				"b/y",
+				"d",
+				"d/z",
+			},
+		},
+		{
+			description: "undo id, source exists",
+			preTest: func(t *testing.T) {
+				dir, err := os.Getwd()
+				requireNoError(t, err)
+				writeJournal(t, journal{Dir: dir,
+					Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Ops:  []op{{kind: opMove, src: "x", dst: "y"}}}, 1, true)
+			},
+			args: []string{"undo", "20000101-000000.000000"},
+			createdFiles: []string{
+				"x",
+				"y",
+			},
+			expectedFiles: []string{
+				"x",
+				"y",
+			},
+			expectedStderr: "self: undoing 20000101-000000.000000 failed: " +
+				"\"x\" already exists\n",
+			expectedExitCode: 1,
+		},
+		{
+			description: "undo, no journals",
+			args:        []string{"undo"},
+			expectedStderr: "self: finding journal failed: " +
+				"no journals found\n",
+			expectedExitCode: 1,
+		},
 
-	nonExecutableEditorPath := filepath.Join(t.TempDir(), "nonexecutable")
-	requireNoError(t, os.WriteFile(nonExecutableEditorPath, nil, 0o644))
+		{
+			description: "recover, finished",
+			preTest: func(t *testing.T) {
+				dir, err := os.Getwd()
+				requireNoError(t, err)
+				// the second op was performed, but not logged
+				writeJournal(t, journal{Dir: dir,
+					Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Ops: []op{
+						{kind: opMove, src: "a", dst: "b"},
+						{kind: opMove, src: "c", dst: "d"},
+						{kind: opMove, src: "e", dst: "f"},
+					}}, 1, false)
+			},
+			args: []string{"recover"},
+			createdFiles: []string{
+				"b",
+				"d",
+				"e",
+			},
+			expectedFiles: []string{
+				"b",
+				"d",
+				"f",
+			},
+		},
+		{
+			description: "recover, rolled back",
+			preTest: func(t *testing.T) {
+				dir, err := os.Getwd()
+				requireNoError(t, err)
+				writeJournal(t, journal{Dir: dir,
+					Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Ops: []op{
+						{kind: opMove, src: "a", dst: "b"},
+						{kind: opMkdir, dst: "c"},
+						{kind: opMove, src: "e", dst: "c/e"},
+					}}, 2, false)
+			},
+			args: []string{"recover", "--rollback", "20000101-000000.000000"},
+			createdFiles: []string{
+				"b",
+				"c/e",
+			},
+			expectedFiles: []string{
+				"a",
+				"e",
+			},
+		},
+		{
+			description: "recover, rolled back from trash",
+			preTest: func(t *testing.T) {
+				trash := filepath.Join(t.TempDir(), "Trash")
+				requireNoError(t, os.MkdirAll(filepath.Join(trash, "files"), 0o700))
+				requireNoError(t, os.MkdirAll(filepath.Join(trash, "info"), 0o700))
+				t.Setenv("XDG_DATA_HOME", filepath.Dir(trash))
+				trashed := filepath.Join(trash, "files", "z")
+				requireNoError(t, os.WriteFile(trashed, nil, 0o644))
 
-	tests := []struct {
-		description string
+				dir, err := os.Getwd()
+				requireNoError(t, err)
+				w, err := createJournal(journal{Dir: dir,
+					Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Ops: []op{
+						{kind: opMove, src: "a", dst: "b"},
+						{kind: opTrash, src: "z"},
+					}})
+				requireNoError(t, err)
+				requireNoError(t, w.log(eventDone, 0))
+				requireNoError(t, w.logEvent(journalEvent{Kind: eventDone,
+					Op: 1, Trashed: trashed}))
+				requireNoError(t, w.f.Close())
+			},
+			args: []string{"recover", "--rollback"},
+			createdFiles: []string{
+				"b",
+			},
+			expectedFiles: []string{
+				"a",
+				"z",
+			},
+		},
+		{
+			description: "recover, interrupted copy",
+			preTest: func(t *testing.T) {
+				dir, err := os.Getwd()
+				requireNoError(t, err)
+				w, err := createJournal(journal{Dir: dir,
+					Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Ops:  []op{{kind: opMove, src: "a", dst: "b"}}})
+				requireNoError(t, err)
+				requireNoError(t, w.logEvent(journalEvent{Kind: eventCopying,
+					Op: 0, Tmp: ".vimv2-x-1"}))
+				requireNoError(t, w.f.Close())
+				requireNoError(t, os.WriteFile(".vimv2-x-1", nil, 0o600))
+			},
+			args: []string{"recover"},
+			createdFiles: []string{
+				"a",
+			},
+			expectedFiles: []string{
+				"b",
+			},
+		},
+		{
+			description: "recover, interrupted while removing copied original",
+			preTest: func(t *testing.T) {
+				dir, err := os.Getwd()
+				requireNoError(t, err)
+				w, err := createJournal(journal{Dir: dir,
+					Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Ops:  []op{{kind: opMove, src: "a", dst: "b"}}})
+				requireNoError(t, err)
+				requireNoError(t, w.logEvent(journalEvent{Kind: eventCopying,
+					Op: 0, Tmp: ".vimv2-x-1"}))
+				requireNoError(t, w.logCopied("a"))
+				requireNoError(t, w.f.Close())
+			},
+			args: []string{"recover"},
+			createdFiles: []string{
+				"a/x",
+				"b/x",
+			},
+			expectedFiles: []string{
+				"b",
+				"b/x",
+			},
+		},
+		{
+			description: "recover, failed",
+			preTest: func(t *testing.T) {
+				dir, err := os.Getwd()
+				requireNoError(t, err)
+				writeJournal(t, journal{Dir: dir,
+					Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Ops:  []op{{kind: opMove, src: "a", dst: "b"}}}, 0, false)
+				t.Cleanup(func() {
+					ids, err := interruptedJournals()
+					requireNoError(t, err)
+					if len(ids) != 1 || ids[0] != "20000101-000000.000000" {
+						t.Errorf("expected the journal to have been kept, "+
+							"but the interrupted runs were: %q", ids)
+					}
+				})
+			},
+			args: []string{"recover"},
+			createdFiles: []string{
+				"a",
+				"b",
+			},
+			expectedFiles: []string{
+				"a",
+				"b",
+			},
+			expectedStderr: "self: run 20000101-000000.000000 is still " +
+				"unfinished, use `vimv2 recover 20000101-000000.000000` to " +
+				"try again\nself: recovering failed: renameat a b: file exists\n",
+			expectedExitCode: 1,
+		},
+		{
+			description:      "recover, nothing interrupted",
+			args:             []string{"recover"},
+			expectedStderr:   "self: no interrupted runs found\n",
+			expectedExitCode: 1,
+		},
+		{
+			description: "interrupted run reported",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "a\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
 
-		preTest      func(t *testing.T)
-		stdin        string
-		createdFiles []string
+				dir, err := os.Getwd()
+				requireNoError(t, err)
+				writeJournal(t, journal{Dir: dir,
+					Time: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Ops:  []op{{kind: opMove, src: "x", dst: "y"}}}, 0, false)
+			},
+			createdFiles:   []string{"a"},
+			expectedFiles:  []string{"a"},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: "self: run 20000101-000000.000000 was interrupted, " +
+				"use `vimv2 recover 20000101-000000.000000` to finish it or " +
+				"roll it back\nmock editor run 0\n",
+		},
 
-		expectedFiles                  []string
-		expectedStdout, expectedStderr string
-		expectedExitCode               int
-	}{
 		{
-			description: "happy path simple",
+			description: "script",
 			preTest: func(t *testing.T) {
 				t.Setenv("EDITOR", mockEditorPath)
 				countFile := filepath.Join(t.TempDir(), "count")
 				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
 				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
-				t.Setenv("MOCK_EDITOR_OUTPUT_0", `d file
-e file
-f file
-`)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "0001 c\n0002 e/d\ne/\n")
 				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
 			},
+			args: []string{"-n", "--script", "-", "sub"},
 			createdFiles: []string{
-				"a file",
-				"b file",
-				"c file",
+				"sub/b",
+				"sub/d",
+				"sub/z",
 			},
 			expectedFiles: []string{
-				"d file",
-				"e file",
-				"f file",
+				"sub",
+				"sub/b",
+				"sub/d",
+				"sub/z",
+			},
+			expectedStdoutRegexp: regexp.MustCompile(`^mock editor run 0
+#!/bin/sh
+# run from within ".*/sub"
+set -eC
+mv -n -- 'b' 'c'
+mkdir -- 'e'
+mv -n -- 'd' 'e/d'
+rm -rf -- 'z'
+$`),
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "script file",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "b\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args:         []string{"--script", "rename.sh"},
+			createdFiles: []string{"a"},
+			expectedFiles: []string{
+				"a",
+				"rename.sh",
 			},
 			expectedStdout: "mock editor run 0\n",
 			expectedStderr: "mock editor run 0\n",
@@ -93,6 +1401,105 @@ f file
 				"fork/exec %s: permission denied\n", nonExecutableEditorPath),
 			expectedExitCode: 1,
 		},
+		{
+			description: "editor with arguments",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", fmt.Sprintf(`'%s' -a "b c"\ d`, mockEditorPath))
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "b file\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			createdFiles:  []string{"a file"},
+			expectedFiles: []string{"b file"},
+			expectedStdout: `mock editor run 0
+["-a" "b c d"]
+a file
+`,
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "editor run by shell",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", fmt.Sprintf(`ARG=x; '%s' "$ARG"`, mockEditorPath))
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_PRINT_INPUT", "")
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "b file\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			createdFiles:  []string{"a file"},
+			expectedFiles: []string{"b file"},
+			expectedStdout: `mock editor run 0
+["x"]
+a file
+`,
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "editor precedence",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", nonExecutableEditorPath)
+				t.Setenv("VIMV2_EDITOR", nonExecutableEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "b file\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			args:           []string{"--editor", mockEditorPath},
+			createdFiles:   []string{"a file"},
+			expectedFiles:  []string{"b file"},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description: "$VIMV2_EDITOR precedence",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", nonExecutableEditorPath)
+				t.Setenv("VIMV2_EDITOR", mockEditorPath)
+				countFile := filepath.Join(t.TempDir(), "count")
+				requireNoError(t, os.WriteFile(countFile, []byte{'0'}, 0o644))
+				t.Setenv("MOCK_EDITOR_COUNT_FILE", countFile)
+				t.Setenv("MOCK_EDITOR_OUTPUT_0", "b file\n")
+				t.Setenv("MOCK_EDITOR_EXIT_CODE_0", "0")
+			},
+			createdFiles:   []string{"a file"},
+			expectedFiles:  []string{"b file"},
+			expectedStdout: "mock editor run 0\n",
+			expectedStderr: "mock editor run 0\n",
+		},
+		{
+			description:   "invalid tmp pattern",
+			args:          []string{"--tmp-pattern", "tmp"},
+			createdFiles:  []string{"a"},
+			expectedFiles: []string{"a"},
+			expectedStderr: "self: invalid --tmp-pattern: temporary name " +
+				"pattern \"tmp\" doesn't contain {n}\n",
+			expectedExitCode: 1,
+		},
+		{
+			description:   "invalid tmp pattern when undoing",
+			args:          []string{"undo", "--tmp-pattern", "{n}/"},
+			createdFiles:  []string{"a"},
+			expectedFiles: []string{"a"},
+			expectedStderr: "self: invalid --tmp-pattern: temporary name " +
+				"pattern \"{n}/\" contains a slash\n",
+			expectedExitCode: 1,
+		},
+		{
+			description: "editor unparseable",
+			preTest: func(t *testing.T) {
+				t.Setenv("EDITOR", `vim "`)
+			},
+			createdFiles:     []string{"a file"},
+			expectedFiles:    []string{"a file"},
+			expectedStderr:   "self: parsing editor command failed: unterminated double quote\n",
+			expectedExitCode: 1,
+		},
 		{
 			description: "editor exits with non-zero",
 			preTest: func(t *testing.T) {
@@ -194,7 +1601,7 @@ self: user exited
 	}
 
 	// prevent external env from polluting tests
-	for _, envVar := range [2]string{"EDITOR", "VISUAL"} {
+	for _, envVar := range [3]string{"EDITOR", "VISUAL", "VIMV2_EDITOR"} {
 		oldVal, found := os.LookupEnv(envVar)
 		if found {
 			requireNoError(t, os.Unsetenv(envVar))
@@ -223,9 +1630,16 @@ self: user exited
 			os.Chdir(tempDir)
 
 			for _, file := range test.createdFiles {
+				requireNoError(t, os.MkdirAll(filepath.Dir(file), 0o755))
 				requireNoError(t, os.WriteFile(file, nil, 0o644))
 			}
 
+			os.Args = append([]string{"self"}, test.args...)
+
+			// keep journals out of both the real state directory and the one
+			// we're checking the contents of
+			t.Setenv("XDG_STATE_HOME", filepath.Join(t.TempDir(), "state"))
+
 			// clear actualExitCode so we can tell when it didn't get set
 			actualExitCode = -1
 
@@ -241,7 +1655,13 @@ self: user exited
 				t.Errorf("expected exit code: %d did not match actual exit "+
 					"code: %d", test.expectedExitCode, actualExitCode)
 			}
-			if test.expectedStdout != actualStdout {
+			if test.expectedStdoutRegexp != nil {
+				if !test.expectedStdoutRegexp.MatchString(actualStdout) {
+					t.Errorf("expected stdout regexp:\n%s\ndid not match "+
+						"actual stdout:\n%s", test.expectedStdoutRegexp,
+						actualStdout)
+				}
+			} else if test.expectedStdout != actualStdout {
 				t.Errorf("expected stdout:\n%s\ndid not match actual "+
 					"stdout:\n%s", test.expectedStdout, actualStdout)
 			}
@@ -250,13 +1670,14 @@ self: user exited
 					"stderr:\n%s", test.expectedStderr, actualStderr)
 			}
 
-			actualEntries, err := os.ReadDir(".")
-			requireNoError(t, err)
-
-			actualFiles := make([]string, len(actualEntries))
-			for i, e := range actualEntries {
-				actualFiles[i] = e.Name()
-			}
+			var actualFiles []string
+			requireNoError(t, filepath.WalkDir(".",
+				func(path string, _ fs.DirEntry, err error) error {
+					if path != "." {
+						actualFiles = append(actualFiles, filepath.ToSlash(path))
+					}
+					return err
+				}))
 
 			if len(test.expectedFiles) == len(actualFiles) {
 				sort.Strings(test.expectedFiles)
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// a mapping is a list of renames read from a file, instead of being edited
+type mapping struct {
+	// srcs and dsts are the pairs that were read, in order
+	srcs, dsts []string
+}
+
+// mappingFormat returns the format of the mapping in file, given the format
+// that was asked for, which can be auto to go by file's extension.
+func mappingFormat(format, file string) string {
+	if format != "auto" {
+		return format
+	}
+	if strings.EqualFold(path.Ext(file), ".csv") {
+		return "csv"
+	}
+
+	return "tsv"
+}
+
+// readMapping reads pairs of srcs and dsts from r, in one of these formats:
+//
+//   - tsv: a line for each pair, with a tab between the src and dst
+//   - csv: a record for each pair, with the src and dst as fields
+//   - nul: srcs and dsts alternating, each followed by a NUL byte
+//
+// In tsv and csv, names are unquoted like they are in the buffer, so names
+// containing tabs or newlines can be written as $'...'. Blank lines are
+// ignored.
+func readMapping(r io.Reader, format string) (mapping, error) {
+	var m mapping
+	seen := map[string]struct{}{}
+	add := func(src, dst string) error {
+		src = path.Clean(src)
+		if _, found := seen[src]; found {
+			return fmt.Errorf("duplicate source %q", src)
+		}
+		seen[src] = struct{}{}
+
+		m.srcs = append(m.srcs, src)
+		m.dsts = append(m.dsts, dst)
+		return nil
+	}
+
+	switch format {
+	case "tsv":
+		scanner := bufio.NewScanner(r)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSuffix(scanner.Text(), "\r")
+			if text == "" {
+				continue
+			}
+
+			src, dst, found := strings.Cut(text, "\t")
+			if !found || strings.Contains(dst, "\t") {
+				return mapping{}, fmt.Errorf("line %d: expected two "+
+					"tab-separated fields", line)
+			}
+			err := addUnquoted(add, src, dst)
+			if err != nil {
+				return mapping{}, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return mapping{}, err
+		}
+
+	case "csv":
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 2
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return mapping{}, err
+			}
+
+			err = addUnquoted(add, record[0], record[1])
+			if err != nil {
+				line, _ := cr.FieldPos(0)
+				return mapping{}, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+
+	case "nul":
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return mapping{}, err
+		}
+		if len(b) == 0 {
+			break
+		}
+		if b[len(b)-1] != 0 {
+			return mapping{}, errors.New("missing NUL after last field")
+		}
+
+		fields := bytes.Split(b[:len(b)-1], []byte{0})
+		if len(fields)%2 != 0 {
+			return mapping{}, errors.New("odd number of fields")
+		}
+		for i := 0; i < len(fields); i += 2 {
+			err := add(string(fields[i]), string(fields[i+1]))
+			if err != nil {
+				return mapping{}, fmt.Errorf("pair %d: %w", i/2+1, err)
+			}
+		}
+
+	default:
+		return mapping{}, fmt.Errorf("unknown format %q", format)
+	}
+
+	return m, nil
+}
+
+// addUnquoted calls add with src and dst after unquoting them.
+func addUnquoted(add func(src, dst string) error, src, dst string) error {
+	src, err := unquote(src)
+	if err != nil {
+		return err
+	}
+	dst, err = unquote(dst)
+	if err != nil {
+		return err
+	}
+
+	return add(src, dst)
+}
+
+// edit returns an edit of srcs where each of m's srcs is renamed to its dst,
+// as if the buffer was edited that way, along with those of m's srcs that
+// aren't in srcs.
+func (m mapping) edit(srcs []string) (edit, []string) {
+	indices := make(map[string]int, len(srcs))
+	for i, src := range srcs {
+		indices[src] = i
+	}
+
+	e := edit{dsts: append([]string(nil), srcs...),
+		deleted: make([]bool, len(srcs)), lines: make([]int, len(srcs))}
+	var missing []string
+	for i, src := range m.srcs {
+		j, found := indices[src]
+		if !found {
+			missing = append(missing, src)
+			continue
+		}
+		e.dsts[j] = m.dsts[i]
+	}
+
+	return e, missing
+}
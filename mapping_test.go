@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_readMapping(t *testing.T) {
+	tests := []struct {
+		format, input          string
+		expectedSrcs, expected []string
+	}{
+		{
+			format:       "tsv",
+			input:        "a\tb\r\n\n./c/\t$'d\\te'\nf g\th i\n",
+			expectedSrcs: []string{"a", "c", "f g"},
+			expected:     []string{"b", "d\te", "h i"},
+		},
+		{
+			format:       "csv",
+			input:        "a,b\n\"c\nd\",\"e,f\"\ng,$'h\\ni'\n",
+			expectedSrcs: []string{"a", "c\nd", "g"},
+			expected:     []string{"b", "e,f", "h\ni"},
+		},
+		{
+			format:       "nul",
+			input:        "a\x00b\x00c\td\x00$'e'\x00",
+			expectedSrcs: []string{"a", "c\td"},
+			expected:     []string{"b", "$'e'"},
+		},
+		{
+			format: "nul",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			m, err := readMapping(strings.NewReader(test.input), test.format)
+			requireNoError(t, err)
+
+			if fmt.Sprintf("%q", test.expectedSrcs) != fmt.Sprintf("%q", m.srcs) {
+				t.Fatalf("expected srcs: %q did not match actual srcs: %q",
+					test.expectedSrcs, m.srcs)
+			}
+			if fmt.Sprintf("%q", test.expected) != fmt.Sprintf("%q", m.dsts) {
+				t.Fatalf("expected: %q did not match actual: %q",
+					test.expected, m.dsts)
+			}
+		})
+	}
+}
+
+func Test_readMapping_invalid(t *testing.T) {
+	tests := []struct {
+		format, input, expectedErr string
+	}{
+		{format: "tsv", input: "a\tb\nc\n", expectedErr: "line 2: expected two tab-separated fields"},
+		{format: "tsv", input: "a\tb\tc\n", expectedErr: "line 1: expected two tab-separated fields"},
+		{format: "tsv", input: "a\tb\n./a\tc\n", expectedErr: `line 2: duplicate source "a"`},
+		{format: "tsv", input: "$'a\tb\n", expectedErr: "line 1: missing closing quote"},
+		{format: "csv", input: "a,b\nc\n", expectedErr: "record on line 2: wrong number of fields"},
+		{format: "nul", input: "a\x00b", expectedErr: "missing NUL after last field"},
+		{format: "nul", input: "a\x00b\x00c\x00", expectedErr: "odd number of fields"},
+		{format: "xml", expectedErr: `unknown format "xml"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expectedErr, func(t *testing.T) {
+			_, err := readMapping(strings.NewReader(test.input), test.format)
+			if err == nil || err.Error() != test.expectedErr {
+				t.Fatalf("expected error: %s did not match actual error: %v",
+					test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func Test_mapping_edit(t *testing.T) {
+	m := mapping{srcs: []string{"b", "a/x", "c"}, dsts: []string{"a", "y", "d"}}
+
+	e, missing := m.edit([]string{"a", "a/x", "b"})
+
+	expected := []string{"a", "y", "a"}
+	if fmt.Sprintf("%q", expected) != fmt.Sprintf("%q", e.dsts) {
+		t.Fatalf("expected: %q did not match actual: %q", expected, e.dsts)
+	}
+	if fmt.Sprintf("%q", missing) != fmt.Sprintf("%q", []string{"c"}) {
+		t.Fatalf("expected only c to be missing, but missing was: %q", missing)
+	}
+}
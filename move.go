@@ -1,47 +1,334 @@
 package main
 
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
 type moveFunc func(src, dst string) error
 
-func moveAll(srcToDst map[string]string, m moveFunc, t tmpFunc) error {
+// an exchangeFunc swaps a and b. tmp is a free name that can be used if that
+// can't be done atomically.
+type exchangeFunc func(a, b, tmp string) error
+
+// exchangeVia swaps a and b using m, by moving a to tmp, b to a, then tmp to
+// b. If that fails part way through, it tries to put things back.
+func exchangeVia(m moveFunc, a, b, tmp string) error {
+	err := m(a, tmp)
+	if err != nil {
+		return err
+	}
+	err = m(b, a)
+	if err != nil {
+		_ = m(tmp, a)
+		return err
+	}
+	err = m(tmp, b)
+	if err != nil {
+		_ = m(a, b)
+		_ = m(tmp, a)
+		return err
+	}
+
+	return nil
+}
+
+type removeFunc func(src string) error
+
+type createFunc func(dst string, dir bool) error
+
+// moveAll moves each key of srcToDst to its value using m, and creates each
+// key of creates using c, as a directory if its value is true, consuming both
+// maps in the process. Paths may contain slashes, in which case moving a
+// directory also moves everything beneath it, so we keep track of where each
+// pending entry currently is as we go. Nothing is moved or created until its
+// destination and the directories containing it are no longer going to
+// change. Each cycle is broken by exchanging its entries into place using x,
+// or if x is nil, by moving one of its entries to a temporary location
+// provided by t.
+//
+// Things are done in the same order every time for the same input, and
+// without recursion, so that plans are reproducible, and large ones don't
+// take quadratic time.
+func moveAll(srcToDst map[string]string, creates map[string]bool, m moveFunc, x exchangeFunc, c createFunc, t tmpFunc) error {
+	// dstToSrc is the inverse of srcToDst, and as entries are moved, the keys
+	// of srcToDst and the values of dstToSrc are updated with their current
+	// locations
+	dstToSrc := make(map[string]string, len(srcToDst))
+	// if no path contains a slash, nothing can be beneath anything else, so
+	// we can skip looking for entries that were moved along with their parent
+	nested := false
 	for src, dst := range srcToDst {
 		if src == dst {
 			delete(srcToDst, src)
 			continue
 		}
 
-		err := moveRec(srcToDst, m, t, map[string]struct{}{}, src, dst)
+		dstToSrc[dst] = src
+		nested = nested || strings.Contains(src, "/")
+	}
+
+	// arriving reports whether something is going to be moved to or created
+	// at p
+	arriving := func(p string) bool {
+		_, moving := dstToSrc[p]
+		_, creating := creates[p]
+		return moving || creating
+	}
+
+	// movedParent returns a directory containing dst that's being moved away
+	// without being replaced, if there is one
+	movedParent := func(dst string) (string, bool) {
+		for parent := path.Dir(dst); parent != "." && parent != "/"; parent = path.Dir(parent) {
+			_, leaving := srcToDst[parent]
+			if leaving && !arriving(parent) {
+				return parent, true
+			}
+		}
+
+		return "", false
+	}
+
+	for _, src := range sortedKeys(srcToDst) {
+		dst := srcToDst[src]
+		if strings.HasPrefix(dst, src+"/") {
+			return fmt.Errorf("cannot move %q into itself", src)
+		}
+		parent, found := movedParent(dst)
+		if found {
+			return fmt.Errorf("cannot move %q to %q because "+
+				"%q is being moved", src, dst, parent)
+		}
+	}
+	for _, dst := range sortedKeys(creates) {
+		parent, found := movedParent(dst)
+		if found {
+			return fmt.Errorf("cannot create %q because %q is "+
+				"being moved", dst, parent)
+		}
+	}
+
+	// settled reports whether all of the directories containing p are
+	// already where they're going to end up
+	settled := func(p string) bool {
+		for parent := path.Dir(p); parent != "." && parent != "/"; parent = path.Dir(parent) {
+			_, leaving := srcToDst[parent]
+			if leaving || arriving(parent) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	// available reports whether dst is free and settled
+	available := func(dst string) bool {
+		_, occupied := srcToDst[dst]
+		return !occupied && settled(dst)
+	}
+
+	// beneath holds the pending entries beneath each location, so that
+	// entries that were moved along with their parent can be found without
+	// looking through every other entry
+	beneath := pathIndex{}
+	track := func(p string, pending bool) {
+		if !nested {
+			return
+		}
+
+		if pending {
+			beneath.add(p)
+		} else {
+			beneath.remove(p)
+		}
+	}
+	for src := range srcToDst {
+		track(src, true)
+	}
+
+	// relocate records that whatever was at the src of each of moved is now
+	// at its dst. They're applied simultaneously, so that exchanges can be
+	// recorded as two moves.
+	type move struct{ src, dst string }
+	relocate := func(moved ...move) {
+		var moves []move
+		for _, mv := range moved {
+			moves = append(moves, mv)
+			for other := range beneath[mv.src] {
+				moves = append(moves,
+					move{other, mv.dst + strings.TrimPrefix(other, mv.src)})
+			}
+		}
+
+		finals := make([]string, len(moves))
+		for i, mv := range moves {
+			finals[i] = srcToDst[mv.src]
+			delete(srcToDst, mv.src)
+			track(mv.src, false)
+		}
+		for i, mv := range moves {
+			if mv.dst == finals[i] {
+				// it's been moved along with its parent into the right place
+				delete(dstToSrc, finals[i])
+			} else {
+				srcToDst[mv.dst] = finals[i]
+				dstToSrc[finals[i]] = mv.dst
+				track(mv.dst, true)
+			}
+		}
+	}
+
+	// chase moves src into place if it can be, then whatever's waiting for
+	// the location that frees up, and so on along the chain, and reports
+	// whether anything was done
+	chase := func(src string) (bool, error) {
+		progress := false
+		for {
+			dst, pending := srcToDst[src]
+			if !pending || !available(dst) {
+				return progress, nil
+			}
+
+			err := m(src, dst)
+			if err != nil {
+				return progress, err
+			}
+			relocate(move{src, dst})
+			progress = true
+
+			if dir, creating := creates[src]; creating {
+				if available(src) {
+					err = c(src, dir)
+					if err != nil {
+						return progress, err
+					}
+					delete(creates, src)
+				}
+				return progress, nil
+			}
+			src = dstToSrc[src]
+		}
+	}
+
+	// inCycle reports whether src is part of a cycle of entries that are all
+	// settled, which can only be resolved by breaking it. Entries it checks
+	// are added to checked, and aren't checked again.
+	inCycle := func(src string, checked map[string]bool) bool {
+		for cur := src; !checked[cur]; {
+			checked[cur] = true
+			if !settled(cur) {
+				return false
+			}
+
+			next, pending := srcToDst[cur]
+			_, occupied := srcToDst[next]
+			if !pending || !occupied || !settled(next) {
+				return false
+			}
+			if next == src {
+				return true
+			}
+			cur = next
+		}
+
+		return false
+	}
+
+	// breakCycle puts every entry of the cycle containing src in place,
+	// either by exchanging src with whatever's in the way until what's at
+	// src belongs there, or by moving src to a temporary location and then
+	// moving the rest of the cycle along
+	breakCycle := func(src string) error {
+		if x != nil {
+			for {
+				dst, pending := srcToDst[src]
+				if !pending {
+					return nil
+				}
+
+				// the temporary name is only used if the exchange can't be
+				// atomic
+				tmp, err := t(src)
+				if err != nil {
+					return err
+				}
+
+				err = x(src, dst, tmp)
+				if err != nil {
+					return err
+				}
+				relocate(move{src, dst}, move{dst, src})
+			}
+		}
+
+		tmpSrc, err := t(src)
 		if err != nil {
 			return err
 		}
-		delete(srcToDst, src)
-	}
-	// as 3. under https://go.dev/ref/spec#For_range indicates, insertions into
-	// maps during range iterations over them are not guaranteed to be
-	// produced, therefore, we must do another iteration, and in this one,
-	// everything is guaranteed to require only one move because we know that
-	// whatever occupied the destinations have already been moved in the
-	// previous loop
-	for src, dst := range srcToDst {
-		err := m(src, dst)
+
+		err = m(src, tmpSrc)
 		if err != nil {
 			return err
 		}
-		delete(srcToDst, src)
+		relocate(move{src, tmpSrc})
+		_, err = chase(dstToSrc[src])
+		return err
 	}
 
-	return nil
-}
+	for len(srcToDst) > 0 || len(creates) > 0 {
+		progress := false
 
-func moveRec(srcToDst map[string]string, m moveFunc, t tmpFunc, seen map[string]struct{}, src, dst string) error {
-	otherSrc := dst
-	otherDst, found := srcToDst[otherSrc]
-	if found {
-		// there is currently a file in the way of the destination
+		for _, src := range sortedKeys(srcToDst) {
+			moved, err := chase(src)
+			if err != nil {
+				return err
+			}
+			progress = progress || moved
+		}
+		for _, dst := range sortedKeys(creates) {
+			dir, creating := creates[dst]
+			if !creating || !available(dst) {
+				continue
+			}
 
-		_, seenOther := seen[otherSrc]
-		if seenOther {
-			// the file that's in the way has already been seen, so there is a
-			// cycle, meaning we'll have to make an additional temporary move
+			err := c(dst, dir)
+			if err != nil {
+				return err
+			}
+			delete(creates, dst)
+			progress = true
+		}
+		if progress {
+			continue
+		}
+
+		// nothing could be moved, so there are cycles, each of which can be
+		// broken independently
+		checked := map[string]bool{}
+		for _, src := range sortedKeys(srcToDst) {
+			if !inCycle(src, checked) {
+				continue
+			}
+
+			err := breakCycle(src)
+			if err != nil {
+				return err
+			}
+			progress = true
+		}
+		if progress {
+			continue
+		}
+
+		// otherwise, something is waiting for a directory containing it to
+		// be moved into place, which we make way for by moving something
+		// that's in the way to a temporary location
+		for _, src := range sortedKeys(srcToDst) {
+			if !arriving(src) {
+				continue
+			}
 
 			tmpSrc, err := t(src)
 			if err != nil {
@@ -52,21 +339,30 @@ func moveRec(srcToDst map[string]string, m moveFunc, t tmpFunc, seen map[string]
 			if err != nil {
 				return err
 			}
-
-			srcToDst[tmpSrc] = dst
-			return nil
+			relocate(move{src, tmpSrc})
+			progress = true
+			break
 		}
-
-		// track that we've seen this; seen never used after a recursive call
-		// within the isolated iteration, so we don't need to worry about it
-		// being mutated by child calls
-		seen[src] = struct{}{}
-		err := moveRec(srcToDst, m, t, seen, otherSrc, otherDst)
-		if err != nil {
-			return err
+		if !progress {
+			for _, src := range sortedKeys(srcToDst) {
+				return fmt.Errorf("unable to move %q to %q", src, srcToDst[src])
+			}
+			for _, dst := range sortedKeys(creates) {
+				return fmt.Errorf("unable to create %q", dst)
+			}
 		}
-		delete(srcToDst, otherSrc)
 	}
 
-	return m(src, dst)
+	return nil
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -51,35 +54,400 @@ func Test_moveAll(t *testing.T) {
 			"y": "z",
 			"z": "x",
 		},
+		{
+			// directory moved along with its contents
+			"a":   "b",
+			"a/x": "b/x",
+			"a/y": "b/y",
+		},
+		{
+			// directory and its contents moved
+			"a":     "b",
+			"a/x":   "b/z",
+			"a/y":   "b/y",
+			"a/y/1": "b/y/2",
+		},
+		{
+			// contents moved out of a moved directory
+			"a":   "b",
+			"a/x": "x",
+			"c":   "b/c",
+		},
+		{
+			// directories swapped
+			"a":   "b",
+			"b":   "a",
+			"a/x": "b/x",
+			"b/y": "a/y",
+		},
+		{
+			// cycle between different levels
+			"a":   "a",
+			"a/b": "b",
+			"b":   "a/b",
+		},
+		{
+			// moved into a directory that's being moved into place
+			"a":   "b",
+			"b":   "c",
+			"d":   "a",
+			"e":   "a/e",
+			"b/f": "c/f",
+		},
 	}
 
 	for _, test := range tests {
-		t.Run(fmt.Sprintf("%v", test), func(t *testing.T) {
-			expected := map[string]string{}
-			for src, dst := range test {
-				expected[dst] = src
+		for _, exchange := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v exchange=%v", test, exchange), func(t *testing.T) {
+				f := newFakeFS(t, test, exchange)
+				f.logging = true
+				f.run()
+			})
+		}
+	}
+}
+
+func Test_moveAll_random(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	for i := 0; i < 200; i++ {
+		// a random permutation of some of the names, where the rest are
+		// moved to new names
+		n := 1 + rng.Intn(20)
+		perm := rng.Perm(n)
+		test := map[string]string{}
+		for src, dst := range perm {
+			if rng.Intn(4) == 0 {
+				dst += n
 			}
+			test[fmt.Sprint(src)] = fmt.Sprint(dst)
+		}
+
+		for _, exchange := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v exchange=%v", test, exchange), func(t *testing.T) {
+				f := newFakeFS(t, test, exchange)
+				f.run()
+
+				// a cycle of n entries takes n-1 exchanges, or one temporary
+				// move and n other moves
+				cycles, cycled := 0, 0
+				visited := map[string]bool{}
+				for src := range test {
+					if visited[src] || test[src] == src {
+						continue
+					}
+
+					length := 0
+					for cur := src; !visited[cur]; cur = test[cur] {
+						visited[cur] = true
+						length++
+						if test[cur] == src {
+							cycles++
+							cycled += length
+						}
+					}
+				}
+				moved := 0
+				for src, dst := range test {
+					if src != dst {
+						moved++
+					}
+				}
+
+				var expectedCalls int
+				if exchange {
+					expectedCalls = moved - cycled + (cycled - cycles)
+				} else {
+					expectedCalls = moved + cycles
+				}
+				if len(f.calls) != expectedCalls {
+					t.Fatalf("expected %d calls, but there were %d: %q",
+						expectedCalls, len(f.calls), f.calls)
+				}
 
-			actual := map[string]string{}
-			for src := range test {
-				actual[src] = src
+				// the same input always results in the same plan
+				g := newFakeFS(t, test, exchange)
+				g.run()
+				if strings.Join(f.calls, "\n") != strings.Join(g.calls, "\n") {
+					t.Fatalf("calls: %q differed from calls for the same "+
+						"input: %q", f.calls, g.calls)
+				}
+			})
+		}
+	}
+}
+
+func Test_moveAll_random_nested(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	for i := 0; i < 100; i++ {
+		// a random permutation of directories, and of the contents of each
+		test := map[string]string{}
+		n := 1 + rng.Intn(5)
+		for src, dst := range rng.Perm(n) {
+			test[fmt.Sprint(src)] = fmt.Sprint(dst)
+
+			m := rng.Intn(5)
+			for srcChild, dstChild := range rng.Perm(m) {
+				if rng.Intn(4) == 0 {
+					dstChild += m
+				}
+				test[fmt.Sprintf("%d/%d", src, srcChild)] =
+					fmt.Sprintf("%d/%d", dst, dstChild)
 			}
+		}
 
-			moveFn := func(src, dst string) error {
-				t.Logf(`move "%s" -> "%s"`, src, dst)
+		for _, exchange := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v exchange=%v", test, exchange), func(t *testing.T) {
+				f := newFakeFS(t, test, exchange)
+				f.run()
 
-				var ok bool
-				actual[dst], ok = actual[src]
-				if !ok {
-					t.Fatal("src didn't exist")
+				g := newFakeFS(t, test, exchange)
+				g.run()
+				if strings.Join(f.calls, "\n") != strings.Join(g.calls, "\n") {
+					t.Fatalf("calls: %q differed from calls for the same "+
+						"input: %q", f.calls, g.calls)
 				}
+			})
+		}
+	}
+}
 
-				delete(actual, src)
+// largePlans returns plans of various shapes, each moving about n entries.
+func largePlans(n int) map[string]map[string]string {
+	plans := map[string]map[string]string{
+		"chain": {},
+		"cycle": {},
+		"swaps": {},
+		// a chain of directories, each containing a chain of files
+		"nested": {},
+	}
+	for i := 0; i < n; i++ {
+		plans["chain"][fmt.Sprint(i)] = fmt.Sprint(i + 1)
+		plans["cycle"][fmt.Sprint(i)] = fmt.Sprint((i + 1) % n)
+		plans["swaps"][fmt.Sprint(i)] = fmt.Sprint(i ^ 1)
+	}
+	for i := 0; i < n/10; i++ {
+		plans["nested"][fmt.Sprint(i)] = fmt.Sprint(i + 1)
+		for j := 0; j < 9; j++ {
+			plans["nested"][fmt.Sprintf("%d/%d", i, j)] =
+				fmt.Sprintf("%d/%d", i+1, j+1)
+		}
+	}
+
+	return plans
+}
+
+func Test_moveAll_large(t *testing.T) {
+	// this is enough to make quadratic passes noticeably slow, while
+	// Benchmark_moveAll_large uses plans of the size that's expected to work
+	for description, test := range largePlans(10000) {
+		for _, exchange := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s exchange=%v", description, exchange), func(t *testing.T) {
+				newFakeFS(t, test, exchange).run()
+			})
+		}
+	}
+}
+
+func Benchmark_moveAll_large(b *testing.B) {
+	for description, test := range largePlans(200000) {
+		for _, exchange := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s exchange=%v", description, exchange), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					newFakeFS(b, test, exchange).run()
+				}
+			})
+		}
+	}
+}
+
+// a fakeFS simulates moving things according to a test case of moveAll,
+// and checks that they end up in the right places.
+type fakeFS struct {
+	t        testing.TB
+	srcToDst map[string]string
+	exchange bool
+	// logging is set if calls should be logged as they're made
+	logging bool
+	// actual maps where things are to where they started
+	actual map[string]string
+	// nested is set if anything is beneath anything else
+	nested bool
+	// beneath holds the things beneath each location, if nested is set
+	beneath pathIndex
+	calls   []string
+}
+
+func newFakeFS(t testing.TB, srcToDst map[string]string, exchange bool) *fakeFS {
+	f := &fakeFS{t: t, srcToDst: srcToDst, exchange: exchange,
+		actual: map[string]string{}, beneath: pathIndex{}}
+	for src := range srcToDst {
+		f.actual[src] = src
+		f.nested = f.nested || strings.Contains(src, "/")
+	}
+	if f.nested {
+		for src := range srcToDst {
+			f.beneath.add(src)
+		}
+	}
+
+	return f
+}
+
+func (f *fakeFS) run() {
+	f.t.Helper()
+
+	srcToDst := map[string]string{}
+	expected := map[string]string{}
+	for src, dst := range f.srcToDst {
+		srcToDst[src] = dst
+		expected[dst] = src
+	}
+
+	var exchangeFn exchangeFunc
+	if f.exchange {
+		exchangeFn = f.exchangeFn
+	}
+	err := moveAll(srcToDst, nil, f.move, exchangeFn, nil,
+		testTmpFunc(f.actual, expected))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	assertMapsEqual(f.t, expected, f.actual)
+}
+
+func (f *fakeFS) call(format string, a ...any) {
+	c := fmt.Sprintf(format, a...)
+	if f.logging {
+		f.t.Log(c)
+	}
+	f.calls = append(f.calls, c)
+}
+
+// relocate moves src and everything beneath it to dst
+func (f *fakeFS) relocate(src, dst string) {
+	if !f.nested {
+		f.actual[dst] = f.actual[src]
+		delete(f.actual, src)
+		return
+	}
+
+	moved := map[string]string{dst: f.actual[src]}
+	delete(f.actual, src)
+	f.beneath.remove(src)
+	for p := range f.beneath[src] {
+		moved[dst+strings.TrimPrefix(p, src)] = f.actual[p]
+		delete(f.actual, p)
+		f.beneath.remove(p)
+	}
+	for p, v := range moved {
+		f.actual[p] = v
+		f.beneath.add(p)
+	}
+}
+
+func (f *fakeFS) checkParent(dst string) {
+	if parent := path.Dir(dst); parent != "." {
+		if _, ok := f.actual[parent]; !ok {
+			f.t.Fatalf("%q's parent didn't exist", dst)
+		}
+	}
+}
+
+func (f *fakeFS) move(src, dst string) error {
+	f.call(`move "%s" -> "%s"`, src, dst)
+
+	if _, ok := f.actual[src]; !ok {
+		f.t.Fatal("src didn't exist")
+	}
+	if _, ok := f.actual[dst]; ok {
+		f.t.Fatal("dst already existed")
+	}
+	f.checkParent(dst)
+
+	f.relocate(src, dst)
+	return nil
+}
+
+func (f *fakeFS) exchangeFn(a, b, tmp string) error {
+	f.call(`exchange "%s" <-> "%s"`, a, b)
+
+	if _, ok := f.actual[a]; !ok {
+		f.t.Fatal("a didn't exist")
+	}
+	if _, ok := f.actual[b]; !ok {
+		f.t.Fatal("b didn't exist")
+	}
+	if _, ok := f.actual[tmp]; ok {
+		f.t.Fatal("tmp already existed")
+	}
+
+	f.relocate(a, tmp)
+	f.relocate(b, a)
+	f.relocate(tmp, b)
+	return nil
+}
+
+func Test_moveAll_creates(t *testing.T) {
+	tests := []struct {
+		srcToDst map[string]string
+		creates  map[string]bool
+	}{
+		{
+			// created in place of something moved away
+			srcToDst: map[string]string{"a": "b"},
+			creates:  map[string]bool{"a": false},
+		},
+		{
+			// created within a new directory
+			srcToDst: map[string]string{"a": "b/a"},
+			creates:  map[string]bool{"b": true, "b/c": false},
+		},
+		{
+			// created in place of something in a cycle
+			srcToDst: map[string]string{"a": "b", "b": "a/b"},
+			creates:  map[string]bool{"a": true},
+		},
+	}
 
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v %v", test.srcToDst, test.creates), func(t *testing.T) {
+			// values are true for directories that exist
+			actual := map[string]bool{}
+			expected := map[string]bool{}
+			for src, dst := range test.srcToDst {
+				actual[src] = false
+				expected[dst] = false
+			}
+			for dst, dir := range test.creates {
+				expected[dst] = dir
+			}
+
+			checkParent := func(dst string) {
+				if _, ok := actual[dst]; ok {
+					t.Fatal("dst already existed")
+				}
+				if parent := path.Dir(dst); parent != "." && !actual[parent] {
+					t.Fatal("dst's parent didn't exist")
+				}
+			}
+			moveFn := func(src, dst string) error {
+				t.Logf(`move "%s" -> "%s"`, src, dst)
+				checkParent(dst)
+				actual[dst] = actual[src]
+				delete(actual, src)
+				return nil
+			}
+			createFn := func(dst string, dir bool) error {
+				t.Logf(`create "%s" %v`, dst, dir)
+				checkParent(dst)
+				actual[dst] = dir
 				return nil
 			}
 
-			actualErr := moveAll(test, moveFn, tmpClosure(actual, expected))
+			actualErr := moveAll(test.srcToDst, test.creates, moveFn, nil,
+				createFn, testTmpFunc(actual, expected))
 
 			if actualErr != nil {
 				t.Fatal(actualErr)
@@ -89,7 +457,51 @@ func Test_moveAll(t *testing.T) {
 	}
 }
 
-func assertMapsEqual[T, U comparable](t *testing.T, expected, actual map[T]U) {
+func Test_moveAll_invalid(t *testing.T) {
+	tests := []struct {
+		srcToDst    map[string]string
+		expectedErr string
+	}{
+		{
+			srcToDst: map[string]string{
+				"a": "a/b",
+			},
+			expectedErr: `cannot move "a" into itself`,
+		},
+		{
+			srcToDst: map[string]string{
+				"a":   "b",
+				"a/x": "a/y",
+			},
+			expectedErr: `cannot move "a/x" to "a/y" because "a" is being moved`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v", test.srcToDst), func(t *testing.T) {
+			moveFn := func(src, dst string) error {
+				t.Fatalf(`unexpected move "%s" -> "%s"`, src, dst)
+				return nil
+			}
+
+			actualErr := moveAll(test.srcToDst, nil, moveFn, nil, nil,
+				testTmpFunc(test.srcToDst, map[string]struct{}{}))
+
+			if actualErr == nil || actualErr.Error() != test.expectedErr {
+				t.Fatalf("expected error: %s did not match actual error: %v",
+					test.expectedErr, actualErr)
+			}
+		})
+	}
+}
+
+// testTmpFunc returns a tmpFunc that provides names that aren't in s1 or s2.
+func testTmpFunc[T, U any](s1 map[string]T, s2 map[string]U) tmpFunc {
+	t := &tmpNamer{pattern: "{n}.tmp", taken: takenIn(s1, s2, nil)}
+	return t.name
+}
+
+func assertMapsEqual[T, U comparable](t testing.TB, expected, actual map[T]U) {
 	t.Helper()
 
 	if len(expected) != len(actual) {
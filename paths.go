@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// readPaths reads paths from r, one per line, or each terminated by a NUL
+// byte if null is set. Empty paths are ignored.
+func readPaths(r io.Reader, null bool) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	if null {
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			if i := bytes.IndexByte(data, 0); i != -1 {
+				return i + 1, data[:i], nil
+			}
+			if atEOF && len(data) > 0 {
+				return len(data), data, nil
+			}
+			return 0, nil, nil
+		})
+	}
+
+	var paths []string
+	for scanner.Scan() {
+		p := scanner.Text()
+		if !null {
+			p = strings.TrimSuffix(p, "\r")
+		}
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	return paths, scanner.Err()
+}
+
+// commonRoot returns the deepest directory that contains all of paths, which
+// must be absolute and clean, along with paths relative to that directory,
+// sorted so that directories come before their contents like they do from
+// listEntries, and without duplicates.
+func commonRoot(paths []string) (string, []string, error) {
+	if len(paths) == 0 {
+		return "", nil, nil
+	}
+
+	within := func(p, dir string) bool {
+		rel, err := filepath.Rel(dir, p)
+		return err == nil && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+
+	root := filepath.Dir(paths[0])
+	for _, p := range paths {
+		if p == filepath.Dir(p) {
+			return "", nil, fmt.Errorf("can't rename %q", p)
+		}
+
+		for !within(filepath.Dir(p), root) {
+			if root == filepath.Dir(root) {
+				return "", nil, fmt.Errorf("%q and %q aren't in a common "+
+					"directory", paths[0], p)
+			}
+			root = filepath.Dir(root)
+		}
+	}
+
+	seen := map[string]struct{}{}
+	var rels []string
+	for _, p := range paths {
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return "", nil, err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if _, found := seen[rel]; !found {
+			seen[rel] = struct{}{}
+			rels = append(rels, rel)
+		}
+	}
+	// comparing with the separators replaced by the lowest possible byte
+	// sorts each directory immediately before its contents
+	sort.Slice(rels, func(i, j int) bool {
+		return strings.ReplaceAll(rels[i], "/", "\x00") <
+			strings.ReplaceAll(rels[j], "/", "\x00")
+	})
+
+	return root, rels, nil
+}
+
+// openTerminal opens the controlling terminal for reading, for use instead of
+// stdin when stdin is being used for input.
+func openTerminal() (*os.File, error) {
+	if runtime.GOOS == "windows" {
+		return os.Open("CONIN$")
+	}
+
+	return os.Open("/dev/tty")
+}
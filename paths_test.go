@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_readPaths(t *testing.T) {
+	tests := []struct {
+		input    string
+		null     bool
+		expected []string
+	}{
+		{input: "a\nb c\r\n\n./d/e", expected: []string{"a", "b c", "./d/e"}},
+		{input: "a\nb\x00\x00c\td\x00e", null: true, expected: []string{"a\nb", "c\td", "e"}},
+		{input: "", expected: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%q", test.input), func(t *testing.T) {
+			actual, err := readPaths(strings.NewReader(test.input), test.null)
+			requireNoError(t, err)
+
+			if fmt.Sprintf("%q", test.expected) != fmt.Sprintf("%q", actual) {
+				t.Fatalf("expected: %q did not match actual: %q",
+					test.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_commonRoot(t *testing.T) {
+	base := t.TempDir()
+
+	tests := []struct {
+		description  string
+		paths        []string
+		expectedRoot string
+		expected     []string
+	}{
+		{
+			description:  "same directory",
+			paths:        []string{"x/b", "x/a", "x/b"},
+			expectedRoot: "x",
+			expected:     []string{"a", "b"},
+		},
+		{
+			description:  "nested",
+			paths:        []string{"x/y/z", "x/y-z", "x/y"},
+			expectedRoot: "x",
+			expected:     []string{"y", "y/z", "y-z"},
+		},
+		{
+			description:  "different directories",
+			paths:        []string{"x/y/a", "x/z/b"},
+			expectedRoot: "x",
+			expected:     []string{"y/a", "z/b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			paths := make([]string, len(test.paths))
+			for i, p := range test.paths {
+				paths[i] = filepath.Join(base, filepath.FromSlash(p))
+			}
+
+			root, actual, err := commonRoot(paths)
+			requireNoError(t, err)
+
+			expectedRoot := filepath.Join(base, test.expectedRoot)
+			if root != expectedRoot {
+				t.Fatalf("expected root: %q did not match actual root: %q",
+					expectedRoot, root)
+			}
+			if fmt.Sprintf("%q", test.expected) != fmt.Sprintf("%q", actual) {
+				t.Fatalf("expected: %q did not match actual: %q",
+					test.expected, actual)
+			}
+		})
+	}
+}
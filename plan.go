@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+type opKind int
+
+const (
+	opMove opKind = iota
+	opCreate
+	opMkdir
+	opRemove
+	opTrash
+	opExchange
+)
+
+// an op is a single filesystem operation that's part of renaming things
+type op struct {
+	kind opKind
+	// src is unused for creations, and dst is only used for moves,
+	// exchanges and creations
+	src, dst string
+	// tmp is only used for exchanges, as a free name to move src to if it
+	// can't be exchanged with dst atomically
+	tmp string
+}
+
+func (o op) String() string {
+	switch o.kind {
+	case opMove:
+		return fmt.Sprintf("move %q -> %q", o.src, o.dst)
+	case opCreate:
+		return fmt.Sprintf("create %q", o.dst)
+	case opMkdir:
+		return fmt.Sprintf("mkdir %q", o.dst)
+	case opRemove:
+		return fmt.Sprintf("delete %q", o.src)
+	case opTrash:
+		return fmt.Sprintf("trash %q", o.src)
+	case opExchange:
+		return fmt.Sprintf("exchange %q <-> %q", o.src, o.dst)
+	default:
+		panic(fmt.Sprintf("unknown op kind %d", o.kind))
+	}
+}
+
+// a recorder provides implementations of moveFunc, exchangeFunc, createFunc
+// and removeFunc which record the ops they're called with instead of performing them
+type recorder struct {
+	ops []op
+	// trash indicates that removals should be recorded as moves to the trash
+	trash bool
+}
+
+func (r *recorder) move(src, dst string) error {
+	r.ops = append(r.ops, op{kind: opMove, src: src, dst: dst})
+	return nil
+}
+
+func (r *recorder) exchange(a, b, tmp string) error {
+	r.ops = append(r.ops, op{kind: opExchange, src: a, dst: b, tmp: tmp})
+	return nil
+}
+
+// exchanger returns r.exchange if exchanges are atomic on this platform, or
+// nil otherwise, since then they're no better than moving things to
+// temporary locations.
+func (r *recorder) exchanger() exchangeFunc {
+	if !atomicExchange {
+		return nil
+	}
+
+	return r.exchange
+}
+
+func (r *recorder) create(dst string, dir bool) error {
+	kind := opCreate
+	if dir {
+		kind = opMkdir
+	}
+	r.ops = append(r.ops, op{kind: kind, dst: dst})
+	return nil
+}
+
+func (r *recorder) remove(src string) error {
+	kind := opRemove
+	if r.trash {
+		kind = opTrash
+	}
+	r.ops = append(r.ops, op{kind: kind, src: src})
+	return nil
+}
+
+// planOps returns the ops that carry out r within d, where things are moved
+// temporarily to names from t, and cycles are broken by exchanging things if
+// exchange is set and that's atomic. Deleted things are trashed instead if
+// trash is set. The maps of r are consumed, like those passed to moveAll.
+//
+// Deletion comes last, since deleted things can't always be restored if
+// something else fails, unless the deleted name is reused, or it's in a
+// directory that's moved, in which case it comes first.
+func planOps(d *dir, r request, trash, exchange bool, t *tmpNamer) ([]op, error) {
+	rec := &recorder{trash: trash}
+	var deleteLast []string
+	for _, src := range r.toDelete {
+		_, reused := r.dstSet[src]
+		_, recreated := r.creates[src]
+		moved := false
+		for parent := path.Dir(src); parent != "."; parent = path.Dir(parent) {
+			dst, found := r.srcToDst[parent]
+			moved = moved || (found && dst != parent)
+		}
+
+		if reused || recreated || moved {
+			err := rec.remove(src)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			deleteLast = append(deleteLast, src)
+		}
+	}
+
+	var exchangeFn exchangeFunc
+	if exchange {
+		exchangeFn = rec.exchanger()
+	}
+	// temporary names are checked against the directory as well as the plan
+	t.taken = takenIn(r.srcToDst, r.dstSet, d)
+	err := moveAll(r.srcToDst, r.creates, rec.move, exchangeFn, rec.create,
+		t.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range deleteLast {
+		err := rec.remove(src)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rec.ops, nil
+}
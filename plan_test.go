@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_planOps(t *testing.T) {
+	tests := []struct {
+		description string
+		request     request
+		trash       bool
+		expectedOps []string
+	}{
+		{
+			description: "deleted last",
+			request: request{
+				srcToDst: map[string]string{"a": "b", "b": "a"},
+				dstSet:   map[string]struct{}{"a": {}, "b": {}},
+				toDelete: []string{"z"},
+			},
+			expectedOps: []string{
+				`move "a" -> "1.tmp"`,
+				`move "b" -> "a"`,
+				`move "1.tmp" -> "b"`,
+				`delete "z"`,
+			},
+		},
+		{
+			description: "deleted name reused",
+			request: request{
+				srcToDst: map[string]string{"b": "a"},
+				dstSet:   map[string]struct{}{"a": {}},
+				toDelete: []string{"a"},
+			},
+			trash: true,
+			expectedOps: []string{
+				`trash "a"`,
+				`move "b" -> "a"`,
+			},
+		},
+		{
+			description: "deleted within moved directory",
+			request: request{
+				srcToDst: map[string]string{"d": "e", "c": "c2"},
+				dstSet:   map[string]struct{}{"e": {}, "c2": {}},
+				toDelete: []string{"d/x"},
+			},
+			expectedOps: []string{
+				`delete "d/x"`,
+				`move "c" -> "c2"`,
+				`move "d" -> "e"`,
+			},
+		},
+		{
+			description: "created",
+			request: request{
+				srcToDst: map[string]string{},
+				dstSet:   map[string]struct{}{"n": {}, "n/m": {}},
+				creates:  map[string]bool{"n": true, "n/m": false},
+			},
+			expectedOps: []string{
+				`mkdir "n"`,
+				`create "n/m"`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tn := &tmpNamer{pattern: "{n}.tmp"}
+			ops, err := planOps(nil, test.request, test.trash, false, tn)
+			requireNoError(t, err)
+
+			actualOps := make([]string, len(ops))
+			for i, o := range ops {
+				actualOps[i] = o.String()
+			}
+			if fmt.Sprintf("%q", test.expectedOps) != fmt.Sprintf("%q", actualOps) {
+				t.Fatalf("expected ops: %q did not match actual ops: %q",
+					test.expectedOps, actualOps)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// atomicExchange indicates that dir.exchange is atomic, at least on
+// filesystems that support it
+const atomicExchange = true
+
+// renameNoReplace renames src to dst within the directory fd, failing with
+// EEXIST if dst already exists.
+func renameNoReplace(fd int, src, dst string) error {
+	err := unix.Renameat2(fd, src, fd, dst, unix.RENAME_NOREPLACE)
+	// older kernels don't have renameat2, and some filesystems don't support
+	// RENAME_NOREPLACE
+	if err != unix.ENOSYS && err != unix.EINVAL {
+		return err
+	}
+
+	return renameLinking(fd, src, dst)
+}
+
+// exchange swaps a and b atomically, or if the filesystem doesn't support
+// that, or they're on different filesystems, by moving a out of the way to
+// tmp.
+func (d *dir) exchange(a, b, tmp string) error {
+	err := unix.Renameat2(d.fd, a, d.fd, b, unix.RENAME_EXCHANGE)
+	switch err {
+	case nil:
+		return nil
+	case unix.ENOSYS, unix.EINVAL, unix.EOPNOTSUPP, unix.EXDEV:
+		return exchangeVia(d.move, a, b, tmp)
+	default:
+		return &os.LinkError{Op: "renameat2", Old: a, New: b, Err: err}
+	}
+}
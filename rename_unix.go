@@ -0,0 +1,19 @@
+//go:build unix && !linux
+
+package main
+
+// atomicExchange indicates that dir.exchange is atomic, which it isn't on this
+// platform
+const atomicExchange = false
+
+// renameNoReplace renames src to dst within the directory fd, failing with
+// EEXIST if dst already exists. There's no rename that does that on this
+// platform, so links or reservations are used instead.
+func renameNoReplace(fd int, src, dst string) error {
+	return renameLinking(fd, src, dst)
+}
+
+// exchange swaps a and b by moving a out of the way to tmp.
+func (d *dir) exchange(a, b, tmp string) error {
+	return exchangeVia(d.move, a, b, tmp)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writeScript writes a POSIX shell script to w which performs ops in order,
+// stopping at the first failure. Nothing that exists is ever overwritten by
+// the script. The script works relative to the directory it's run from, so
+// that it can be used with copies of the same tree, so dir, which the ops
+// were planned for, is only mentioned in a comment.
+func writeScript(w io.Writer, dir string, ops []op) error {
+	bw := bufio.NewWriter(w)
+
+	// -C prevents the redirections used to create files from clobbering
+	// anything
+	fmt.Fprintf(bw, "#!/bin/sh\n# run from within %q\nset -eC\n", dir)
+
+	for _, o := range ops {
+		switch o.kind {
+		case opMove:
+			fmt.Fprintf(bw, "mv -n -- %s %s\n",
+				shellQuote(o.src), shellQuote(o.dst))
+		case opCreate:
+			fmt.Fprintf(bw, ": > %s\n", shellQuote(o.dst))
+		case opMkdir:
+			fmt.Fprintf(bw, "mkdir -- %s\n", shellQuote(o.dst))
+		case opRemove:
+			fmt.Fprintf(bw, "rm -rf -- %s\n", shellQuote(o.src))
+		default:
+			return fmt.Errorf("%s can't be written as a shell command", o)
+		}
+	}
+
+	// errors are sticky, so this reports any from the writes above
+	return bw.Flush()
+}
+
+// shellQuote quotes s so that a POSIX shell will interpret it as a single
+// word with no expansions
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func Test_writeScript(t *testing.T) {
+	ops := []op{
+		{kind: opRemove, src: "-rf"},
+		{kind: opMove, src: "it's", dst: "a\nb"},
+		{kind: opMkdir, dst: "c"},
+		{kind: opMove, src: "d", dst: "c/d"},
+		{kind: opCreate, dst: "$e"},
+	}
+
+	var b strings.Builder
+	requireNoError(t, writeScript(&b, "/sub dir", ops))
+
+	expected := `#!/bin/sh
+# run from within "/sub dir"
+set -eC
+rm -rf -- '-rf'
+mv -n -- 'it'\''s' 'a
+b'
+mkdir -- 'c'
+mv -n -- 'd' 'c/d'
+: > '$e'
+`
+	if b.String() != expected {
+		t.Fatalf("expected script:\n%s\ndid not match actual script:\n%s",
+			expected, b.String())
+	}
+
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available")
+	}
+
+	tempDir := t.TempDir()
+	dir := filepath.Join(tempDir, "sub dir")
+	requireNoError(t, os.Mkdir(dir, 0o755))
+	for _, name := range []string{"-rf", "it's", "d"} {
+		requireNoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+
+	cmd := exec.Command("sh", "-c", b.String())
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	requireNoError(t, err, "running script failed with output %s", out)
+
+	for _, name := range []string{"a\nb", "c/d", "$e"} {
+		_, err := os.Lstat(filepath.Join(dir, name))
+		requireNoError(t, err)
+	}
+	for _, name := range []string{"-rf", "it's", "d"} {
+		_, err := os.Lstat(filepath.Join(dir, name))
+		if !os.IsNotExist(err) {
+			t.Fatalf("expected %q not to exist, but got: %v", name, err)
+		}
+	}
+}
+
+func Test_writeScript_trash(t *testing.T) {
+	var b strings.Builder
+	err := writeScript(&b, ".", []op{{kind: opTrash, src: "a"}})
+
+	expectedErr := `trash "a" can't be written as a shell command`
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("expected error: %s did not match actual error: %v",
+			expectedErr, err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"syscall"
+)
+
+// an identity distinguishes a file from others, including any that replace it
+// at the same path. Where device and inode numbers aren't available, only the
+// type of the file is compared.
+type identity struct {
+	dev, ino uint64
+	typ      fs.FileMode
+}
+
+// snapshot returns the identities of srcs, so that changes to them can be
+// detected later.
+func snapshot(d *dir, srcs []string) ([]identity, error) {
+	ids := make([]identity, len(srcs))
+	for i, src := range srcs {
+		info, err := d.lstat(src)
+		if err != nil {
+			return nil, err
+		}
+
+		ids[i].dev, ids[i].ino, _ = fileID(info)
+		ids[i].typ = info.Mode().Type()
+	}
+
+	return ids, nil
+}
+
+// findChanges returns descriptions of the ways in which srcs have changed
+// since ids was snapshotted, and of anything that's appeared at dsts, which
+// would be clobbered by moving things there.
+func findChanges(d *dir, srcs []string, ids []identity, dsts map[string]struct{}) ([]string, error) {
+	var changes []string
+
+	current, err := snapshotExisting(d, srcs)
+	if err != nil {
+		return nil, err
+	}
+	srcSet := map[string]struct{}{}
+	for i, src := range srcs {
+		srcSet[src] = struct{}{}
+
+		if current[i] == nil {
+			changes = append(changes, fmt.Sprintf("%q was removed", src))
+		} else if *current[i] != ids[i] {
+			changes = append(changes, fmt.Sprintf("%q was replaced", src))
+		}
+	}
+
+	sortedDsts := make([]string, 0, len(dsts))
+	for dst := range dsts {
+		_, isSrc := srcSet[dst]
+		if !isSrc {
+			sortedDsts = append(sortedDsts, dst)
+		}
+	}
+	sort.Strings(sortedDsts)
+
+	existing, err := snapshotExisting(d, sortedDsts)
+	if err != nil {
+		return nil, err
+	}
+	for i, dst := range sortedDsts {
+		if existing[i] != nil {
+			changes = append(changes, fmt.Sprintf("%q already exists", dst))
+		}
+	}
+
+	return changes, nil
+}
+
+// snapshotExisting is like snapshot, but the identities of things that don't
+// exist are nil instead of causing an error.
+func snapshotExisting(d *dir, names []string) ([]*identity, error) {
+	ids := make([]*identity, len(names))
+	for i, name := range names {
+		id, err := snapshot(d, []string{name})
+		// nothing can exist beneath something that isn't a directory
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		ids[i] = &id[0]
+	}
+
+	return ids, nil
+}
+
+// refreshEdit returns an edit of srcs, which is a new listing of the
+// directory, that carries over what e did to oldSrcs, for the srcs that are
+// still there.
+func refreshEdit(oldSrcs []string, e edit, srcs []string) edit {
+	oldIndices := map[string]int{}
+	for i, src := range oldSrcs {
+		oldIndices[src] = i
+	}
+
+	refreshed := edit{
+		dsts:    make([]string, len(srcs)),
+		deleted: make([]bool, len(srcs)),
+		creates: e.creates,
+	}
+	for i, src := range srcs {
+		j, found := oldIndices[src]
+		if !found {
+			refreshed.dsts[i] = src
+			continue
+		}
+
+		refreshed.dsts[i] = e.dsts[j]
+		refreshed.deleted[i] = e.deleted[j]
+	}
+
+	return refreshed
+}
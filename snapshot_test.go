@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_findChanges(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	srcs := []string{"a", "b", "c", "d"}
+	for _, src := range srcs {
+		requireNoError(t, os.WriteFile(filepath.Join(tempDir, src), nil, 0o644))
+	}
+	ids, err := snapshot(d, srcs)
+	requireNoError(t, err)
+
+	requireNoError(t, os.Remove(filepath.Join(tempDir, "a")))
+	// b is replaced by something of a different type, since that's all that
+	// can be detected on some platforms
+	requireNoError(t, os.Remove(filepath.Join(tempDir, "b")))
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "b"), 0o755))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "e"), nil, 0o644))
+
+	changes, err := findChanges(d, srcs, ids, map[string]struct{}{
+		"c":   {},
+		"d/f": {},
+		"e":   {},
+		"g":   {},
+	})
+	requireNoError(t, err)
+
+	expected := []string{`"a" was removed`, `"b" was replaced`,
+		`"e" already exists`}
+	if fmt.Sprintf("%q", expected) != fmt.Sprintf("%q", changes) {
+		t.Fatalf("expected changes: %q did not match actual changes: %q",
+			expected, changes)
+	}
+}
+
+func Test_refreshEdit(t *testing.T) {
+	oldSrcs := []string{"a", "b", "c"}
+	e := edit{
+		dsts:    []string{"x", "b", "y"},
+		deleted: []bool{false, true, false},
+		creates: []string{"z/"},
+	}
+
+	actual := refreshEdit(oldSrcs, e, []string{"a0", "a", "b", "d"})
+
+	expected := edit{
+		dsts:    []string{"a0", "x", "b", "d"},
+		deleted: []bool{false, false, true, false},
+		creates: []string{"z/"},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected: %+v did not match actual: %+v", expected, actual)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// the parts of a name that a substitution can be restricted to
+const (
+	partWhole = iota
+	// partStem is everything before the extension
+	partStem
+	// partExt is the extension, without the dot
+	partExt
+)
+
+// a substitution replaces matches of re in names with repl, which can refer
+// to submatches like regexp.Regexp.Expand does
+type substitution struct {
+	re   *regexp.Regexp
+	repl string
+	// global is set if every match should be replaced, instead of just the
+	// first
+	global bool
+	// part is the part of names that's matched and replaced within
+	part int
+}
+
+// parseSubstitution parses expr, which is like s/regex/repl/flags in sed,
+// where the slashes can be any other character as well, as long as it's
+// escaped with a backslash wherever it occurs in regex or repl. The flags
+// are:
+//
+//   - g: replace every match instead of just the first
+//   - i: match case-insensitively
+//   - s: only match within the stem of names
+//   - x: only match within the extension of names
+func parseSubstitution(expr string) (substitution, error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return substitution{}, errors.New("expected s/regex/repl/flags")
+	}
+	delim := expr[1]
+	if delim == '\\' || delim == '\n' {
+		return substitution{}, fmt.Errorf("invalid delimiter %q", delim)
+	}
+
+	// fields are split at unescaped delimiters, and the backslashes that
+	// escape delimiters are removed, while others are left for the regexp
+	var fields []string
+	var b strings.Builder
+	for i := 2; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && i+1 < len(expr) && expr[i+1] == delim:
+			b.WriteByte(delim)
+			i++
+		case expr[i] == '\\' && i+1 < len(expr):
+			b.WriteString(expr[i : i+2])
+			i++
+		case expr[i] == delim && len(fields) < 2:
+			fields = append(fields, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(expr[i])
+		}
+	}
+	if len(fields) < 2 {
+		return substitution{}, fmt.Errorf("missing closing %q", delim)
+	}
+
+	var s substitution
+	pattern, flags := fields[0], b.String()
+	s.repl = fields[1]
+	for _, flag := range flags {
+		switch flag {
+		case 'g':
+			s.global = true
+		case 'i':
+			pattern = "(?i)" + pattern
+		case 's', 'x':
+			if s.part != partWhole {
+				return substitution{}, errors.New("flags s and x can't be combined")
+			}
+			s.part = partStem
+			if flag == 'x' {
+				s.part = partExt
+			}
+		default:
+			return substitution{}, fmt.Errorf("unknown flag %q", flag)
+		}
+	}
+
+	var err error
+	s.re, err = regexp.Compile(pattern)
+	return s, err
+}
+
+// apply returns the result of s on name, which is a filename rather than a
+// path.
+func (s substitution) apply(name string) string {
+	stem, ext := splitExt(name)
+	switch s.part {
+	case partStem:
+		return s.replace(stem) + ext
+	case partExt:
+		if ext == "" {
+			return name
+		}
+		return stem + "." + s.replace(ext[1:])
+	default:
+		return s.replace(name)
+	}
+}
+
+func (s substitution) replace(text string) string {
+	if s.global {
+		return s.re.ReplaceAllString(text, s.repl)
+	}
+
+	match := s.re.FindStringSubmatchIndex(text)
+	if match == nil {
+		return text
+	}
+	result := s.re.ExpandString([]byte(text[:match[0]]), s.repl, text, match)
+	return string(result) + text[match[1]:]
+}
+
+// substitute returns an edit of srcs where each of subs has been applied to
+// the name of each src in order, as if the buffer was edited that way.
+func substitute(srcs []string, subs []substitution) edit {
+	e, _ := renameEach(srcs, func(_ int, src string) (string, error) {
+		name := path.Base(src)
+		for _, s := range subs {
+			name = s.apply(name)
+		}
+		return name, nil
+	})
+
+	return e
+}
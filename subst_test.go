@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_parseSubstitution(t *testing.T) {
+	tests := []struct {
+		expr     string
+		names    []string
+		expected []string
+	}{
+		{
+			expr:     `s/^IMG_(\d+)/photo-$1/`,
+			names:    []string{"IMG_0001.jpg", "IMG_.jpg", "x IMG_1"},
+			expected: []string{"photo-0001.jpg", "IMG_.jpg", "x IMG_1"},
+		},
+		{
+			expr:     `s/a/b/`,
+			names:    []string{"aaa"},
+			expected: []string{"baa"},
+		},
+		{
+			expr:     `s/a/${0}b/g`,
+			names:    []string{"aaa"},
+			expected: []string{"ababab"},
+		},
+		{
+			expr:     `s/a/b/gi`,
+			names:    []string{"aAa"},
+			expected: []string{"bbb"},
+		},
+		{
+			expr:     `s|/|\||`,
+			names:    []string{"a/b"},
+			expected: []string{"a|b"},
+		},
+		{
+			expr:     `s/\./_/gs`,
+			names:    []string{"a.b.tar", ".a.b", "a.b"},
+			expected: []string{"a_b.tar", "_a.b", "a.b"},
+		},
+		{
+			expr:     `s/jpeg/jpg/x`,
+			names:    []string{"jpeg.jpeg", "jpeg", ".jpeg"},
+			expected: []string{"jpeg.jpg", "jpeg", ".jpeg"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			s, err := parseSubstitution(test.expr)
+			requireNoError(t, err)
+
+			actual := make([]string, len(test.names))
+			for i, name := range test.names {
+				actual[i] = s.apply(name)
+			}
+			if fmt.Sprintf("%q", test.expected) != fmt.Sprintf("%q", actual) {
+				t.Fatalf("expected: %q did not match actual: %q",
+					test.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_parseSubstitution_invalid(t *testing.T) {
+	tests := []struct {
+		expr, expectedErr string
+	}{
+		{expr: "y/a/b/", expectedErr: "expected s/regex/repl/flags"},
+		{expr: "s/a/b", expectedErr: `missing closing '/'`},
+		{expr: `s/a\/b/`, expectedErr: `missing closing '/'`},
+		{expr: "s/a/b/q", expectedErr: `unknown flag 'q'`},
+		{expr: "s/a/b/sx", expectedErr: "flags s and x can't be combined"},
+		{expr: "s/(/b/", expectedErr: "error parsing regexp: missing closing ): `(`"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			_, err := parseSubstitution(test.expr)
+			if err == nil || err.Error() != test.expectedErr {
+				t.Fatalf("expected error: %s did not match actual error: %v",
+					test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func Test_substitute(t *testing.T) {
+	var subs []substitution
+	for _, expr := range []string{"s/a/b/", "s/b/c/g", "s/^x$//"} {
+		s, err := parseSubstitution(expr)
+		requireNoError(t, err)
+		subs = append(subs, s)
+	}
+
+	e := substitute([]string{"a", "a/ab", "a/y", "x"}, subs)
+
+	expected := []string{"c", "c/cc", "c/y", ""}
+	if fmt.Sprintf("%q", expected) != fmt.Sprintf("%q", e.dsts) {
+		t.Fatalf("expected: %q did not match actual: %q", expected, e.dsts)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build aix || dragonfly || solaris
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// readlink returns the target of the symlink name.
+func (d *dir) readlink(name string) (string, error) {
+	p := d.join(name)
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlink(p, buf)
+		if err != nil {
+			return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+		}
+		// the target may have been truncated if it filled the buffer
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// symlink creates name as a symlink to target.
+func (d *dir) symlink(target, name string) error {
+	err := unix.Symlink(target, d.join(name))
+	if err != nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// join joins name with the path the directory was opened with, since the *at
+// versions of the symlink syscalls aren't available on this platform.
+func (d *dir) join(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(d.path, name)
+}
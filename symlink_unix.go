@@ -0,0 +1,34 @@
+//go:build unix && !(aix || dragonfly || solaris)
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readlink returns the target of the symlink name.
+func (d *dir) readlink(name string) (string, error) {
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(d.fd, name, buf)
+		if err != nil {
+			return "", &os.PathError{Op: "readlinkat", Path: name, Err: err}
+		}
+		// the target may have been truncated if it filled the buffer
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// symlink creates name as a symlink to target.
+func (d *dir) symlink(target, name string) error {
+	err := unix.Symlinkat(target, d.fd, name)
+	if err != nil {
+		return &os.PathError{Op: "symlinkat", Path: name, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// defaultTimeLayout is the layout that times are formatted with in templates
+// when one isn't given
+const defaultTimeLayout = "2006-01-02"
+
+// a template describes names in terms of what they're being renamed from.
+// Templates are made of literal text, and fields in braces like
+// {field:spec|filter}, where the spec and filters are optional, and literal
+// braces are written as {{ and }}. The fields are:
+//
+//   - name: the original name
+//   - stem: the original name without its extension
+//   - ext: the extension of the original name, including the dot
+//   - parent: the name of the directory the original is in
+//   - size: the size of the original in bytes
+//   - mtime, ctime: the modification and change times of the original, for
+//     which the spec is a layout for time.Time.Format
+//   - n: a counter, for which the spec is WIDTH:START:STEP, where each part
+//     is optional, and numbers are padded with zeros to WIDTH digits
+//
+// The filters are lower and upper, which change the case of the field.
+type template []templatePart
+
+// a templatePart is either literal text, or a field when field is set
+type templatePart struct {
+	literal string
+	field   string
+	spec    string
+	filters []string
+	// width, start, and step are parsed from spec for counters
+	width, start, step int
+}
+
+func parseTemplate(s string) (template, error) {
+	var t template
+	var literal strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"), strings.HasPrefix(s[i:], "}}"):
+			literal.WriteByte(s[i])
+			i++
+
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end == -1 {
+				return nil, errors.New("missing closing }")
+			}
+			part, err := parseField(s[i+1 : i+end])
+			if err != nil {
+				return nil, err
+			}
+
+			if literal.Len() > 0 {
+				t = append(t, templatePart{literal: literal.String()})
+				literal.Reset()
+			}
+			t = append(t, part)
+			i += end
+
+		case s[i] == '}':
+			return nil, errors.New("unexpected }, use }} for a literal }")
+
+		default:
+			literal.WriteByte(s[i])
+		}
+	}
+	if literal.Len() > 0 {
+		t = append(t, templatePart{literal: literal.String()})
+	}
+
+	return t, nil
+}
+
+// parseField parses the contents of a field of a template, without the
+// braces.
+func parseField(s string) (templatePart, error) {
+	filters := strings.Split(s, "|")
+	part := templatePart{field: filters[0], filters: filters[1:]}
+	if i := strings.IndexByte(part.field, ':'); i != -1 {
+		part.field, part.spec = part.field[:i], part.field[i+1:]
+	}
+
+	for _, filter := range part.filters {
+		if filter != "lower" && filter != "upper" {
+			return templatePart{}, fmt.Errorf("unknown filter %q", filter)
+		}
+	}
+
+	switch part.field {
+	case "name", "stem", "ext", "parent", "size":
+		if part.spec != "" {
+			return templatePart{}, fmt.Errorf("field %q doesn't take a spec",
+				part.field)
+		}
+
+	case "mtime", "ctime":
+		if part.spec == "" {
+			part.spec = defaultTimeLayout
+		}
+
+	case "n":
+		part.start, part.step = 1, 1
+		numbers := strings.Split(part.spec, ":")
+		if len(numbers) > 3 {
+			return templatePart{}, fmt.Errorf("invalid counter spec %q",
+				part.spec)
+		}
+		for i, dst := range []*int{&part.width, &part.start, &part.step} {
+			if i >= len(numbers) || numbers[i] == "" {
+				continue
+			}
+
+			var err error
+			*dst, err = strconv.Atoi(numbers[i])
+			if err != nil || (i == 0 && *dst < 0) {
+				return templatePart{}, fmt.Errorf("invalid counter spec %q",
+					part.spec)
+			}
+		}
+
+	default:
+		return templatePart{}, fmt.Errorf("unknown field %q", part.field)
+	}
+
+	return part, nil
+}
+
+// execute returns the name that t describes for src, which info describes.
+// i is the index of src among the things that t is being executed for, and
+// top is the name of the directory that things without a parent are in.
+func (t template) execute(src string, info fs.FileInfo, i int, top string) string {
+	var b strings.Builder
+	for _, part := range t {
+		if part.field == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+
+		name := path.Base(src)
+		stem, ext := splitExt(name)
+		var value string
+		switch part.field {
+		case "name":
+			value = name
+		case "stem":
+			value = stem
+		case "ext":
+			value = ext
+		case "parent":
+			value = path.Base(path.Dir(src))
+			if value == "." {
+				value = top
+			}
+		case "size":
+			value = strconv.FormatInt(info.Size(), 10)
+		case "mtime":
+			value = info.ModTime().Format(part.spec)
+		case "ctime":
+			value = changeTime(info).Format(part.spec)
+		case "n":
+			value = fmt.Sprintf("%0*d", part.width, part.start+i*part.step)
+		}
+
+		for _, filter := range part.filters {
+			switch filter {
+			case "lower":
+				value = strings.ToLower(value)
+			case "upper":
+				value = strings.ToUpper(value)
+			}
+		}
+		b.WriteString(value)
+	}
+
+	return b.String()
+}
+
+// applyTemplate returns an edit of srcs within d where each src is renamed to
+// what t describes for it. top is the name of d.
+func applyTemplate(d *dir, t template, srcs []string, top string) (edit, error) {
+	return renameEach(srcs, func(i int, src string) (string, error) {
+		info, err := d.lstat(src)
+		if err != nil {
+			return "", err
+		}
+
+		return t.execute(src, info, i, top), nil
+	})
+}
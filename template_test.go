@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_applyTemplate(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "Dir"), 0o755))
+	for _, file := range []string{"Dir/IMG.JPG", "Dir/.hidden", "notes"} {
+		requireNoError(t, os.WriteFile(filepath.Join(tempDir, file),
+			[]byte(file), 0o644))
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.Local)
+	requireNoError(t, os.Chtimes(filepath.Join(tempDir, "notes"), mtime, mtime))
+
+	srcs := []string{"Dir", "Dir/.hidden", "Dir/IMG.JPG", "notes"}
+
+	tests := []struct {
+		template string
+		expected []string
+	}{
+		{
+			template: "{name}",
+			expected: []string{"Dir", "Dir/.hidden", "Dir/IMG.JPG", "notes"},
+		},
+		{
+			template: "{n:03}-{stem|lower}{ext}",
+			expected: []string{"001-dir", "001-dir/002-.hidden",
+				"001-dir/003-img.JPG", "004-notes"},
+		},
+		{
+			template: "{n::10:-5}_{parent|upper}",
+			expected: []string{"10_TOP", "10_TOP/5_DIR", "10_TOP/0_DIR",
+				"-5_TOP"},
+		},
+		{
+			template: "{{{n:2}}}",
+			expected: []string{"{01}", "{01}/{02}", "{01}/{03}", "{04}"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			tmpl, err := parseTemplate(test.template)
+			requireNoError(t, err)
+
+			e, err := applyTemplate(d, tmpl, srcs, "top")
+			requireNoError(t, err)
+
+			if fmt.Sprintf("%q", test.expected) != fmt.Sprintf("%q", e.dsts) {
+				t.Fatalf("expected: %q did not match actual: %q",
+					test.expected, e.dsts)
+			}
+		})
+	}
+
+	// directories' sizes depend on the filesystem, so this is only checked
+	// for a file
+	t.Run("mtime and size", func(t *testing.T) {
+		tmpl, err := parseTemplate("{mtime}_{mtime:15.04.05}_{size}")
+		requireNoError(t, err)
+
+		e, err := applyTemplate(d, tmpl, []string{"notes"}, "top")
+		requireNoError(t, err)
+
+		if e.dsts[0] != "2001-02-03_04.05.06_5" {
+			t.Fatalf("expected: 2001-02-03_04.05.06_5 did not match actual: %s",
+				e.dsts[0])
+		}
+	})
+}
+
+func Test_parseTemplate_invalid(t *testing.T) {
+	tests := []struct {
+		template, expectedErr string
+	}{
+		{template: "{name", expectedErr: "missing closing }"},
+		{template: "name}", expectedErr: "unexpected }, use }} for a literal }"},
+		{template: "{nmae}", expectedErr: `unknown field "nmae"`},
+		{template: "{name|title}", expectedErr: `unknown filter "title"`},
+		{template: "{ext:x}", expectedErr: `field "ext" doesn't take a spec`},
+		{template: "{n:x}", expectedErr: `invalid counter spec "x"`},
+		{template: "{n:-1}", expectedErr: `invalid counter spec "-1"`},
+		{template: "{n:1:2:3:4}", expectedErr: `invalid counter spec "1:2:3:4"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			_, err := parseTemplate(test.template)
+			if err == nil || err.Error() != test.expectedErr {
+				t.Fatalf("expected error: %s did not match actual error: %v",
+					test.expectedErr, err)
+			}
+		})
+	}
+}
@@ -12,10 +12,17 @@ import (
 //
 // - $MOCK_EDITOR_COUNT_FILE: which contains a path to a file that will store
 //   the number of times the editor has been invoked this test run
-// - $MOCK_EDITOR_OUTPUT_n: the data to write to os.Args[1] for run n
+// - $MOCK_EDITOR_OUTPUT_n: the data to write to the file passed as the last
+//   argument for run n
 // - $MOCK_EDITOR_EXIT_CODE_n: the code to exit with for run n
+// - $MOCK_EDITOR_PRINT_INPUT: if set, the arguments and the contents of the
+//   file are printed to stdout before it is overwritten
+// - $MOCK_EDITOR_CREATE_n: a path to create an empty file at during run n, as
+//   if another process had
 
 func main() {
+	file := os.Args[len(os.Args)-1]
+
 	countFile, ok := os.LookupEnv("MOCK_EDITOR_COUNT_FILE")
 	if !ok {
 		panic("$MOCK_EDITOR_COUNT_FILE unset")
@@ -39,16 +46,35 @@ func main() {
 		panic(err)
 	}
 
+	_, ok = os.LookupEnv("MOCK_EDITOR_PRINT_INPUT")
+	if ok {
+		input, err := os.ReadFile(file)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("%q\n", os.Args[1:len(os.Args)-1])
+		fmt.Print(string(input))
+	}
+
 	output, ok := os.LookupEnv(fmt.Sprintf("MOCK_EDITOR_OUTPUT_%d", n))
 	if !ok {
 		panic(fmt.Sprintf("$MOCK_EDITOR_OUTPUT_%d unset", n))
 	}
 
-	err = os.WriteFile(os.Args[1], []byte(output), 0o644)
+	err = os.WriteFile(file, []byte(output), 0o644)
 	if err != nil {
 		panic(err)
 	}
 
+	create, ok := os.LookupEnv(fmt.Sprintf("MOCK_EDITOR_CREATE_%d", n))
+	if ok {
+		err = os.WriteFile(create, nil, 0o644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	ecStr, ok := os.LookupEnv(fmt.Sprintf("MOCK_EDITOR_EXIT_CODE_%d", n))
 	if !ok {
 		panic(fmt.Sprintf("$MOCK_EDITOR_EXIT_CODE_%d unset", n))
@@ -1,23 +1,119 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
 )
 
 type tmpFunc func(src string) (tmpSrc string, err error)
 
-func tmpClosure[T, U any](s1 map[string]T, s2 map[string]U) tmpFunc {
-	return func(src string) (string, error) {
-		for i := 0; i < 10000; i++ {
-			tmpSrc := fmt.Sprintf("%s.tmp%d", src, rand.Int())
-			_, found1 := s1[tmpSrc]
-			_, found2 := s2[tmpSrc]
-			if !(found1 || found2) {
-				return tmpSrc, nil
-			}
+// defaultTmpPattern is the pattern temporary names are made from by default,
+// which makes them hidden, and recognizable as ours
+const defaultTmpPattern = ".vimv2-{session}-{n}"
+
+// validateTmpPattern checks that names made from pattern are distinct, and
+// stay in the directory of the things they're for.
+func validateTmpPattern(pattern string) error {
+	if !strings.Contains(pattern, "{n}") {
+		return fmt.Errorf("temporary name pattern %q doesn't contain {n}",
+			pattern)
+	}
+	if strings.Contains(pattern, "/") {
+		return fmt.Errorf("temporary name pattern %q contains a slash",
+			pattern)
+	}
+
+	return nil
+}
+
+// a tmpNamer provides temporary names for things that have to be moved out
+// of the way. Names are made from pattern, by replacing {session} with
+// session, and {n} with a number that's incremented for each name, so that
+// they're recognizable, and plans are reproducible. Each name is in the same
+// directory as the thing it's for. Names are only checked when they're
+// chosen, so they have to be used in ways that fail if something has taken
+// them since, like renaming without replacing, or creating exclusively.
+type tmpNamer struct {
+	pattern, session string
+	// taken reports whether a name is already in use, in which case it's
+	// skipped
+	taken func(name string) (bool, error)
+	n     int
+	// names are the names that have been provided so far
+	names []string
+}
+
+func (t *tmpNamer) name(src string) (string, error) {
+	for i := 0; i < 10000; i++ {
+		t.n++
+		tmpSrc := strings.NewReplacer("{session}", t.session,
+			"{n}", fmt.Sprint(t.n)).Replace(t.pattern)
+		tmpSrc = path.Join(path.Dir(src), tmpSrc)
+
+		taken, err := t.taken(tmpSrc)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			t.names = append(t.names, tmpSrc)
+			return tmpSrc, nil
+		}
+	}
+
+	return "", fmt.Errorf("failed to find temporary location for %s", src)
+}
+
+// takenIn returns a function that reports whether a name is a key of s1 or
+// s2, or exists within d, unless d is nil.
+func takenIn[T, U any](s1 map[string]T, s2 map[string]U, d *dir) func(string) (bool, error) {
+	return func(name string) (bool, error) {
+		_, found1 := s1[name]
+		_, found2 := s2[name]
+		if found1 || found2 || d == nil {
+			return found1 || found2, nil
 		}
 
-		return "", fmt.Errorf("failed to find temporary location for %s", src)
+		exists, err := lexists(d, name)
+		// name's directory may not have been moved into place yet, in which
+		// case renaming with noreplace will protect whatever's there then
+		if errors.Is(err, syscall.ENOTDIR) {
+			return false, nil
+		}
+		return exists, err
 	}
 }
+
+// leftoverTmps returns those of tmps that still exist within d, because
+// something was left there after a run was interrupted or couldn't be rolled
+// back.
+func leftoverTmps(d *dir, tmps []string) ([]string, error) {
+	var leftover []string
+	for _, tmp := range tmps {
+		exists, err := lexists(d, tmp)
+		if errors.Is(err, syscall.ENOTDIR) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if exists {
+			leftover = append(leftover, tmp)
+		}
+	}
+
+	return leftover, nil
+}
+
+// lexists reports whether name exists within d, without following it if
+// it's a symlink.
+func lexists(d *dir, name string) (bool, error) {
+	_, err := d.lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
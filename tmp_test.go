@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_tmpNamer(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, ".vimv2-s-1"), nil, 0o644))
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "a"), 0o755))
+
+	tn := &tmpNamer{pattern: defaultTmpPattern, session: "s",
+		taken: takenIn(map[string]string{".vimv2-s-2": "x"}, map[string]bool{}, d)}
+	var actual []string
+	for _, src := range []string{"b", "a/c", "missing/d"} {
+		name, err := tn.name(src)
+		requireNoError(t, err)
+		actual = append(actual, name)
+	}
+
+	// the first two are taken on disk and in the plan respectively
+	expected := []string{".vimv2-s-3", "a/.vimv2-s-4", "missing/.vimv2-s-5"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected names: %q did not match actual names: %q",
+			expected, actual)
+	}
+	if !reflect.DeepEqual(expected, tn.names) {
+		t.Fatalf("expected recorded names: %q did not match actual recorded "+
+			"names: %q", expected, tn.names)
+	}
+
+	leftover, err := leftoverTmps(d, []string{".vimv2-s-1", ".vimv2-s-3"})
+	requireNoError(t, err)
+	if !reflect.DeepEqual([]string{".vimv2-s-1"}, leftover) {
+		t.Fatalf("expected leftover: %q but found: %q", ".vimv2-s-1", leftover)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// a trashFunc moves src to the trash, and returns the absolute path it ended
+// up at
+type trashFunc func(src string) (string, error)
+
+// trashClosure returns a trashFunc that moves things from d into the trash,
+// as described by the freedesktop.org trash specification
+// (https://specifications.freedesktop.org/trash-spec/trashspec-latest.html).
+// Things on the same filesystem as the home trash go there, while things on
+// other filesystems go to the trash directory at the top of their filesystem.
+func trashClosure(d *dir, now func() time.Time) (trashFunc, error) {
+	absDir, err := filepath.Abs(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	homeTrash := filepath.Join(dataHome, "Trash")
+
+	return func(src string) (string, error) {
+		info, err := d.lstat(src)
+		if err != nil {
+			return "", err
+		}
+		abs := filepath.Join(absDir, filepath.FromSlash(src))
+
+		// try the home trash first, since that's where things should go when
+		// possible
+		err = trashDirInit(homeTrash, false)
+		if err != nil {
+			return "", err
+		}
+		sameDevice, err := onDevice(d, homeTrash, info)
+		if err != nil {
+			return "", err
+		}
+		if sameDevice {
+			return trashTo(d, src, abs, homeTrash, abs, now())
+		}
+
+		// find the top of the filesystem that src is on
+		topDir := filepath.Dir(abs)
+		for {
+			parent := filepath.Dir(topDir)
+			if parent == topDir {
+				break
+			}
+
+			sameDevice, err := onDevice(d, parent, info)
+			if err != nil {
+				return "", err
+			}
+			if !sameDevice {
+				break
+			}
+			topDir = parent
+		}
+		rel, err := filepath.Rel(topDir, abs)
+		if err != nil {
+			return "", err
+		}
+		uid := strconv.Itoa(os.Getuid())
+
+		// the administrator may have created a shared trash directory, but we
+		// must only use it if it's sticky and isn't a symlink
+		shared := filepath.Join(topDir, ".Trash")
+		sharedInfo, err := d.lstat(shared)
+		if err == nil && sharedInfo.IsDir() &&
+			sharedInfo.Mode()&fs.ModeSticky != 0 {
+			trash := filepath.Join(shared, uid)
+			if trashDirInit(trash, true) == nil {
+				return trashTo(d, src, abs, trash, rel, now())
+			}
+		}
+
+		trash := filepath.Join(topDir, ".Trash-"+uid)
+		err = trashDirInit(trash, true)
+		if err != nil {
+			return "", fmt.Errorf("no usable trash directory for \"%s\": %w", src, err)
+		}
+		return trashTo(d, src, abs, trash, rel, now())
+	}, nil
+}
+
+// onDevice reports whether p is on the same device as the file described by
+// info. If the device can't be determined, everything is assumed to be on the
+// same device.
+func onDevice(d *dir, p string, info fs.FileInfo) (bool, error) {
+	pInfo, err := d.lstat(p)
+	if err != nil {
+		return false, err
+	}
+
+	pDev, _, ok1 := fileID(pInfo)
+	dev, _, ok2 := fileID(info)
+	return !(ok1 && ok2) || pDev == dev, nil
+}
+
+// trashDirInit ensures that the files and info directories of trash exist. If
+// the trash is at the top of a filesystem, it must not be a symlink, since it
+// may be in a directory others can write to.
+func trashDirInit(trash string, topDir bool) error {
+	if topDir {
+		err := os.Mkdir(trash, 0o700)
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+
+		info, err := os.Lstat(trash)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("\"%s\" is not a directory", trash)
+		}
+	}
+
+	for _, sub := range [2]string{"files", "info"} {
+		err := os.MkdirAll(filepath.Join(trash, sub), 0o700)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trashTo moves src, whose absolute path is abs, into trash, and returns
+// where it ended up. infoPath is the path recorded in the trashinfo file,
+// which is what the file will be restored to.
+func trashTo(d *dir, src, abs, trash, infoPath string, deletionDate time.Time) (string, error) {
+	// the trashinfo file is created exclusively first to reserve the name in
+	// the trash, as the specification requires
+	base := filepath.Base(abs)
+	name := base
+	var infoFile *os.File
+	for i := 2; ; i++ {
+		var err error
+		infoFile, err = os.OpenFile(
+			filepath.Join(trash, "info", name+".trashinfo"),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+
+		name = fmt.Sprintf("%s.%d", base, i)
+	}
+
+	escapedPath := (&url.URL{Path: filepath.ToSlash(infoPath)}).EscapedPath()
+	_, err := fmt.Fprintf(infoFile, "[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		escapedPath, deletionDate.Format("2006-01-02T15:04:05"))
+	if err == nil {
+		err = infoFile.Sync()
+	}
+	closeErr := infoFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	trashed := filepath.Join(trash, "files", name)
+	if err == nil {
+		err = d.rename(src, trashed)
+	}
+	if err != nil {
+		// the trashinfo file is useless if the file didn't make it into the
+		// trash
+		os.Remove(infoFile.Name())
+		return "", err
+	}
+
+	return trashed, nil
+}
+
+// untrash moves trashed, which is where a trashFunc put src, back to src
+// within d, and removes its trashinfo file.
+func untrash(d *dir, trashed, src string) error {
+	err := d.rename(trashed, src)
+	if err != nil {
+		return err
+	}
+
+	trash := filepath.Dir(filepath.Dir(trashed))
+	err = os.Remove(filepath.Join(trash, "info",
+		filepath.Base(trashed)+".trashinfo"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
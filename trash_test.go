@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_trashClosure(t *testing.T) {
+	dataHome := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", dataHome)
+	trash := filepath.Join(dataHome, "Trash")
+
+	d, tempDir := openTempDir(t)
+
+	deletionDate := time.Date(2022, 10, 1, 12, 30, 0, 0, time.Local)
+	remove, err := trashClosure(d, func() time.Time { return deletionDate })
+	requireNoError(t, err)
+
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "sub"), 0o755))
+	for i, expectedName := range []string{"a file%", "a file%.2"} {
+		requireNoError(t, os.WriteFile(filepath.Join(tempDir, "sub", "a file%"),
+			[]byte{byte(i)}, 0o644))
+
+		trashed, err := remove("sub/a file%")
+		requireNoError(t, err)
+		if trashed != filepath.Join(trash, "files", expectedName) {
+			t.Fatalf("expected trashed path: %s did not match actual trashed "+
+				"path: %s", filepath.Join(trash, "files", expectedName), trashed)
+		}
+
+		b, err := os.ReadFile(filepath.Join(trash, "files", expectedName))
+		requireNoError(t, err)
+		if len(b) != 1 || b[0] != byte(i) {
+			t.Fatalf("trashed file %s had unexpected contents %v",
+				expectedName, b)
+		}
+
+		b, err = os.ReadFile(filepath.Join(trash, "info",
+			expectedName+".trashinfo"))
+		requireNoError(t, err)
+		expectedInfo := "[Trash Info]\nPath=" +
+			filepath.ToSlash(tempDir) + "/sub/a%20file%25\n" +
+			"DeletionDate=2022-10-01T12:30:00\n"
+		if string(b) != expectedInfo {
+			t.Fatalf("expected trashinfo:\n%s\ndid not match actual "+
+				"trashinfo:\n%s", expectedInfo, b)
+		}
+	}
+
+	_, err = os.Lstat(filepath.Join(tempDir, "sub", "a file%"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected trashed file not to exist, but got: %v", err)
+	}
+
+	requireNoError(t, untrash(d, filepath.Join(trash, "files", "a file%.2"),
+		"sub/a file%"))
+	b, err := os.ReadFile(filepath.Join(tempDir, "sub", "a file%"))
+	requireNoError(t, err)
+	if len(b) != 1 || b[0] != 1 {
+		t.Fatalf("restored file had unexpected contents %v", b)
+	}
+	_, err = os.Lstat(filepath.Join(trash, "info", "a file%.2.trashinfo"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected trashinfo not to exist, but got: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// listEntries returns the paths of the entries in d, relative to d, with
+// directories listed before their contents. Directories are descended into up
+// to maxDepth levels deep, where a maxDepth of 1 lists only the direct
+// children of d, and a maxDepth of 0 means there is no limit.
+func listEntries(d *dir, maxDepth int) ([]string, error) {
+	var paths []string
+
+	var walk func(name string, depth int) error
+	walk = func(name string, depth int) error {
+		entries, err := d.readDir(name)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			p := path.Join(name, entry.Name())
+			paths = append(paths, p)
+
+			if entry.IsDir() && depth != maxDepth {
+				err := walk(p, depth+1)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	err := walk(".", 1)
+	return paths, err
+}
+
+// followParents updates the destinations of entries that were left unchanged
+// but are within a directory that's being moved, so that they're moved along
+// with the directory instead of being left behind. srcs must list directories
+// before their contents, like listEntries does.
+func followParents(srcs, dsts []string) {
+	srcToDst := make(map[string]string, len(srcs))
+	for i, src := range srcs {
+		parent := path.Dir(src)
+		parentDst, found := srcToDst[parent]
+		if found && dsts[i] == src && parentDst != parent {
+			dsts[i] = path.Join(parentDst, path.Base(src))
+		}
+		srcToDst[src] = dsts[i]
+	}
+}
+
+// renameEach returns an edit of srcs where the name of each src is replaced
+// with what rename returns for it and its index, as if the buffer was edited
+// that way. Entries stay in the same directory, which is wherever their
+// parent is moved to. srcs must list directories before their contents, like
+// listEntries does.
+func renameEach(srcs []string, rename func(i int, src string) (string, error)) (edit, error) {
+	e := edit{dsts: make([]string, len(srcs)), deleted: make([]bool, len(srcs)),
+		lines: make([]int, len(srcs))}
+	srcToDst := make(map[string]string, len(srcs))
+	for i, src := range srcs {
+		name, err := rename(i, src)
+		if err != nil {
+			return edit{}, err
+		}
+		dir := path.Dir(src)
+		if dirDst, found := srcToDst[dir]; found {
+			dir = dirDst
+		}
+
+		// names aren't cleaned, so that invalid ones are caught by preflight
+		// instead of turning into something else
+		if dir == "." || name == "" {
+			e.dsts[i] = name
+		} else {
+			e.dsts[i] = dir + "/" + name
+		}
+		srcToDst[src] = e.dsts[i]
+	}
+
+	return e, nil
+}
+
+// splitExt splits name into its stem and its extension, which starts with
+// the last dot, unless that's at the start, since hidden files without
+// another dot don't have an extension.
+func splitExt(name string) (stem, ext string) {
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 {
+		return name, ""
+	}
+
+	return name[:dot], name[dot:]
+}
+
+// findParent returns the innermost directory containing p that's in set, if
+// there is one
+func findParent[T any](p string, set map[string]T) (string, bool) {
+	for parent := path.Dir(p); parent != "." && parent != "/"; parent = path.Dir(parent) {
+		_, found := set[parent]
+		if found {
+			return parent, true
+		}
+	}
+
+	return "", false
+}
+
+// a pathIndex records which of a set of paths are beneath each directory,
+// so that everything beneath a directory can be found without looking
+// through every path
+type pathIndex map[string]map[string]struct{}
+
+// add adds p to the index, beneath each of the directories containing it.
+func (ix pathIndex) add(p string) {
+	for parent := path.Dir(p); parent != "." && parent != "/"; parent = path.Dir(parent) {
+		if ix[parent] == nil {
+			ix[parent] = map[string]struct{}{}
+		}
+		ix[parent][p] = struct{}{}
+	}
+}
+
+// remove removes p from the index.
+func (ix pathIndex) remove(p string) {
+	for parent := path.Dir(p); parent != "." && parent != "/"; parent = path.Dir(parent) {
+		delete(ix[parent], p)
+		if len(ix[parent]) == 0 {
+			delete(ix, parent)
+		}
+	}
+}
+
+// createParents adds the parent directories of the directories in creates to
+// it, unless they're in dsts, or exists reports that they'll already be
+// there once everything else has been moved.
+func createParents(creates map[string]bool, dsts map[string]struct{}, exists func(string) bool) {
+	for p, dir := range creates {
+		if !dir {
+			continue
+		}
+
+		for parent := path.Dir(p); parent != "." && parent != "/"; parent = path.Dir(parent) {
+			_, isDst := dsts[parent]
+			_, creating := creates[parent]
+			if isDst || creating || exists(parent) {
+				break
+			}
+
+			creates[parent] = true
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_followParents(t *testing.T) {
+	tests := []struct {
+		srcs, dsts, expected []string
+	}{
+		{
+			// nothing moved
+			srcs:     []string{"a", "a/b"},
+			dsts:     []string{"a", "a/b"},
+			expected: []string{"a", "a/b"},
+		},
+		{
+			// unchanged entries follow
+			srcs:     []string{"a", "a/b", "a/b/c", "a/d"},
+			dsts:     []string{"x", "a/b", "a/b/c", "a/e"},
+			expected: []string{"x", "x/b", "x/b/c", "a/e"},
+		},
+		{
+			// only direct parents are followed
+			srcs:     []string{"a", "a/b", "a/b/c"},
+			dsts:     []string{"x", "y", "a/b/c"},
+			expected: []string{"x", "y", "y/c"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v -> %v", test.srcs, test.dsts), func(t *testing.T) {
+			followParents(test.srcs, test.dsts)
+
+			if fmt.Sprint(test.expected) != fmt.Sprint(test.dsts) {
+				t.Fatalf("expected dsts: %v did not match actual dsts: %v",
+					test.expected, test.dsts)
+			}
+		})
+	}
+}
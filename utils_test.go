@@ -110,6 +110,19 @@ func redirectRecover(t *testing.T, f func(), stdin string) (stdout, stderr strin
 	return stdoutBuf.String(), stderrBuf.String()
 }
 
+// openTempDir opens a new temporary directory, which is closed and removed
+// once the test has finished, and returns it along with its path.
+func openTempDir(t *testing.T) (d *dir, tempDir string) {
+	t.Helper()
+
+	tempDir = t.TempDir()
+	d, err := openDir(tempDir)
+	requireNoError(t, err)
+	t.Cleanup(func() { requireNoError(t, d.Close()) })
+
+	return d, tempDir
+}
+
 func requireNoError(t *testing.T, err error, args ...any) {
 	t.Helper()
 	if err != nil {
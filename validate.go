@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	// nameMax is the maximum length of a filename in bytes, as on Linux
+	nameMax = 255
+	// pathMax is the maximum length of a path in bytes, as on Linux. Some
+	// platforms have lower limits, in which case too long paths are only
+	// caught when they're used.
+	pathMax = 4096
+)
+
+// a problem is a reason that an entry of an edit can't be carried out
+type problem struct {
+	// src is the entry that the problem is with, or "" if it's with
+	// something that's being created
+	src string
+	// dst is where the entry is being moved to or created
+	dst string
+	msg string
+}
+
+func (p problem) String() string {
+	return p.msg
+}
+
+// a request is what an edit asks to be done, once it's been interpreted
+type request struct {
+	// srcToDst maps each src that isn't being deleted to its cleaned
+	// destination, and dstSet holds those destinations, along with those of
+	// creates
+	srcToDst map[string]string
+	dstSet   map[string]struct{}
+	// deleted holds every src that's being deleted, and toDelete those that
+	// aren't deleted along with a directory containing them, in the order of
+	// srcs
+	deleted  map[string]struct{}
+	toDelete []string
+	// creates maps the things to create to whether they're directories
+	creates map[string]bool
+	// written holds how destinations that were changed by cleaning them
+	// were written, so that problems with them can be reported that way
+	written map[string]string
+	// srcLines and createLines are the lines that srcs and creates were read
+	// from, if any
+	srcLines, createLines map[string]int
+}
+
+// line returns the line of the buffer that p is about, or 0 if there isn't
+// one, like for problems with deleted entries, and parents that are created
+// implicitly.
+func (r request) line(p problem) int {
+	if p.src != "" {
+		return r.srcLines[p.src]
+	}
+
+	return r.createLines[p.dst]
+}
+
+// interpretEdit works out what e asks to be done to srcs, which are the
+// entries of d that were edited. If that doesn't make sense, the first
+// problem that's found is returned along with it.
+func interpretEdit(d *dir, srcs []string, e edit) (request, []problem) {
+	r := request{srcToDst: map[string]string{}, dstSet: map[string]struct{}{},
+		deleted: map[string]struct{}{}, creates: map[string]bool{},
+		written: map[string]string{}, srcLines: map[string]int{},
+		createLines: map[string]int{}}
+	for i, src := range srcs {
+		if i < len(e.lines) {
+			r.srcLines[src] = e.lines[i]
+		}
+	}
+
+	// e is left as it was read, in case the buffer has to be refreshed
+	dsts := append([]string(nil), e.dsts...)
+	for i, dst := range dsts {
+		dsts[i] = cleanDst(dst)
+		if dsts[i] != dst {
+			r.written[dsts[i]] = dst
+		}
+	}
+	followParents(srcs, dsts)
+
+	for i, src := range srcs {
+		if !e.deleted[i] {
+			continue
+		}
+
+		// anything beneath a deleted directory is deleted along with it, so
+		// it doesn't need to be deleted separately
+		_, found := findParent(src, r.deleted)
+		if !found {
+			r.toDelete = append(r.toDelete, src)
+		}
+		r.deleted[src] = struct{}{}
+	}
+
+	for i, src := range srcs {
+		if e.deleted[i] {
+			continue
+		}
+
+		parent, found := findParent(src, r.deleted)
+		if found {
+			return r, []problem{{src: src, msg: fmt.Sprintf(
+				"cannot delete %q without deleting %q", parent, src)}}
+		}
+
+		_, found = r.dstSet[dsts[i]]
+		if found {
+			return r, []problem{{src: src, dst: dsts[i],
+				msg: fmt.Sprintf("duplicate destination %q", dsts[i])}}
+		}
+		r.srcToDst[src] = dsts[i]
+		r.dstSet[dsts[i]] = struct{}{}
+	}
+
+	for j, dst := range e.creates {
+		dir := strings.HasSuffix(dst, "/")
+		clean := cleanDst(dst)
+		if clean != dst {
+			r.written[clean] = dst
+		}
+		if j < len(e.createLines) {
+			r.createLines[clean] = e.createLines[j]
+		}
+		_, found := r.dstSet[clean]
+		if found {
+			return r, []problem{{dst: clean,
+				msg: fmt.Sprintf("duplicate destination %q", clean)}}
+		}
+		r.creates[clean] = dir
+		r.dstSet[clean] = struct{}{}
+	}
+
+	// parent directories of new directories are created as well, if they
+	// won't already exist
+	createParents(r.creates, r.dstSet, func(p string) bool {
+		dst, found := r.srcToDst[p]
+		if found {
+			return dst == p
+		}
+		_, found = r.deleted[p]
+		if found {
+			return false
+		}
+		_, err := d.lstat(p)
+		return err == nil
+	})
+
+	return r, nil
+}
+
+// cleanDst returns dst cleaned by path.Clean, unless it's empty, so that it's
+// still reported as empty.
+func cleanDst(dst string) string {
+	if dst == "" {
+		return ""
+	}
+
+	return path.Clean(dst)
+}
+
+// usedAsDirs returns the paths that dst, as it was written, requires to be
+// directories, which are those followed by "..", and dst itself if it ends
+// with a "/".
+func usedAsDirs(dst string) []string {
+	var dirs []string
+	names := strings.Split(dst, "/")
+	for i, name := range names {
+		if name == ".." && i > 0 {
+			dirs = append(dirs, path.Clean(strings.Join(names[:i], "/")))
+		}
+	}
+	if len(dst) > 1 && strings.HasSuffix(dst, "/") {
+		dirs = append(dirs, path.Clean(dst))
+	}
+
+	return dirs
+}
+
+// preflight checks the destinations of srcToDst and creates, given that
+// deleted will have been deleted, so that problems are found before anything
+// is changed, instead of part way through. Destinations must have been
+// cleaned by cleanDst, and written holds how those that were changed by that
+// were written. srcs are all of the entries that were listed, and listed are
+// the directories whose contents were, since findChanges is responsible for
+// anything that appears in those. All of the problems that are found are
+// returned, in the order of srcs, then creates.
+func preflight(d *dir, srcs []string, listed map[string]struct{}, srcToDst map[string]string, written map[string]string, creates map[string]bool, deleted map[string]struct{}) ([]problem, error) {
+	var problems []problem
+
+	srcSet := make(map[string]struct{}, len(srcs))
+	for _, src := range srcs {
+		srcSet[src] = struct{}{}
+	}
+	dstToSrc := map[string]string{}
+	for src, dst := range srcToDst {
+		if src != dst {
+			dstToSrc[dst] = src
+		}
+	}
+
+	// final returns where whatever's at p now will be once everything's
+	// moved, given that directories take their contents with them, or "" if
+	// it'll be deleted
+	final := func(p string) string {
+		for parent := p; parent != "." && parent != "/"; parent = path.Dir(parent) {
+			if _, deleting := deleted[parent]; deleting {
+				return ""
+			}
+			dst, found := srcToDst[parent]
+			if found {
+				return dst + p[len(parent):]
+			}
+		}
+
+		return p
+	}
+
+	// exists is like lexists, except that nothing can exist beneath
+	// something that isn't a directory
+	exists := func(p string) (bool, error) {
+		found, err := lexists(d, p)
+		if errors.Is(err, syscall.ENOTDIR) {
+			return false, nil
+		}
+		return found, err
+	}
+
+	// origin is the opposite of final, it returns where whatever will be at
+	// p once everything's moved is now
+	origin := func(p string) string {
+		for parent := p; parent != "." && parent != "/"; parent = path.Dir(parent) {
+			src, moving := dstToSrc[parent]
+			if moving {
+				return src + p[len(parent):]
+			}
+		}
+
+		return p
+	}
+
+	// isDir reports whether p will be a directory once everything's moved,
+	// and whether it will exist at all
+	isDir := func(p string) (dir, found bool, err error) {
+		if dir, creating := creates[p]; creating {
+			return dir, true, nil
+		}
+
+		o := origin(p)
+		if final(o) != p {
+			return false, false, nil
+		}
+		info, err := d.lstat(o)
+		if err == nil && info.Mode().Type() == fs.ModeSymlink {
+			// symlinks to directories are followed when they're a parent
+			info, err = d.lstat(o + "/.")
+			if errors.Is(err, syscall.ENOTDIR) {
+				return false, true, nil
+			}
+		}
+		if err != nil {
+			found, err := exists(o)
+			return false, found, err
+		}
+		return info.IsDir(), true, nil
+	}
+
+	// unwritable directories are only reported once
+	checkedDirs := map[string]bool{}
+	checkWritable := func(p problem, dir string) error {
+		if _, checked := checkedDirs[dir]; checked {
+			return nil
+		}
+
+		writable, err := d.writable(dir)
+		if err != nil {
+			return err
+		}
+		checkedDirs[dir] = writable
+		if !writable {
+			p.msg = fmt.Sprintf("directory %q isn't writable", dir)
+			problems = append(problems, p)
+		}
+		return nil
+	}
+
+	check := func(src, dst string) error {
+		report := func(format string, a ...any) {
+			problems = append(problems,
+				problem{src: src, dst: dst, msg: fmt.Sprintf(format, a...)})
+		}
+		// problems are reported with destinations as they were written
+		shown := dst
+		if w, found := written[dst]; found {
+			shown = w
+		}
+
+		if dst == "" {
+			report("empty destination for %q", src)
+			return nil
+		}
+		if strings.ContainsRune(dst, 0) {
+			report("destination %q contains a NUL byte", shown)
+			return nil
+		}
+		if base := path.Base(dst); base == "." || base == ".." || base == "/" {
+			report("destination %q isn't a valid name", shown)
+			return nil
+		}
+		if len(dst) > pathMax {
+			report("destination %q is longer than %d bytes", shown, pathMax)
+			return nil
+		}
+		for _, name := range strings.Split(dst, "/") {
+			if len(name) > nameMax {
+				report("destination %q contains a name longer than %d bytes",
+					shown, nameMax)
+				return nil
+			}
+		}
+
+		parent := path.Dir(dst)
+		if parent != "." && parent != "/" {
+			dir, exists, err := isDir(parent)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				report("parent directory of %q won't exist", shown)
+				return nil
+			}
+			if !dir {
+				report("parent of %q won't be a directory", shown)
+				return nil
+			}
+		}
+
+		// trailing slashes and ".." only work after directories, even though
+		// they're cleaned away
+		for _, p := range usedAsDirs(shown) {
+			if p == "." || p == "/" {
+				continue
+			}
+			dir, _, err := isDir(p)
+			if err != nil {
+				return err
+			}
+			if !dir {
+				report("%q won't be a directory, but %q uses it as one", p,
+					shown)
+				return nil
+			}
+		}
+
+		// moving requires permission to write to both parent directories
+		if src != "" {
+			err := checkWritable(problem{src: src, dst: dst}, path.Dir(src))
+			if err != nil {
+				return err
+			}
+		}
+		// new directories will be created by us, so they'll be writable
+		if _, creating := creates[parent]; !creating {
+			err := checkWritable(problem{src: src, dst: dst}, origin(parent))
+			if err != nil {
+				return err
+			}
+		}
+
+		// anything that wasn't listed that would end up at dst would be
+		// clobbered
+		o := path.Join(origin(parent), path.Base(dst))
+		_, isSrc := srcSet[o]
+		_, isListed := listed[path.Dir(o)]
+		if isSrc || isListed || final(o) != dst {
+			return nil
+		}
+		found, err := exists(o)
+		if err != nil {
+			return err
+		}
+		if found {
+			report("%q already exists", dst)
+		}
+		return nil
+	}
+
+	for _, src := range srcs {
+		if _, deleting := deleted[src]; deleting {
+			err := checkWritable(problem{src: src}, path.Dir(src))
+			if err != nil {
+				return nil, err
+			}
+
+			// deleting a directory deletes everything in it, so that has to
+			// have been listed, and deleted as well
+			if _, isListed := listed[src]; isListed {
+				continue
+			}
+			info, err := d.lstat(src)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				continue
+			}
+			entries, err := d.readDir(src)
+			if err != nil {
+				return nil, err
+			}
+			if len(entries) > 0 {
+				problems = append(problems, problem{src: src,
+					msg: fmt.Sprintf("cannot delete %q, since %q wasn't listed",
+						src, path.Join(src, entries[0].Name()))})
+			}
+			continue
+		}
+
+		dst, found := srcToDst[src]
+		if !found || dst == src {
+			continue
+		}
+		err := check(src, dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sortedCreates := make([]string, 0, len(creates))
+	for dst := range creates {
+		sortedCreates = append(sortedCreates, dst)
+	}
+	sort.Strings(sortedCreates)
+	for _, dst := range sortedCreates {
+		err := check("", dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return problems, nil
+}
+
+// listedDirs returns the directories whose contents listEntries listed when
+// it returned srcs, given maxDepth, and the identities of srcs.
+func listedDirs(srcs []string, ids []identity, maxDepth int) map[string]struct{} {
+	listed := map[string]struct{}{".": {}}
+	for i, src := range srcs {
+		depth := strings.Count(src, "/") + 1
+		if ids[i].typ == fs.ModeDir && depth != maxDepth {
+			listed[src] = struct{}{}
+		}
+	}
+
+	return listed
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func Test_preflight(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	for _, dir := range []string{"d", "e"} {
+		requireNoError(t, os.Mkdir(filepath.Join(tempDir, dir), 0o755))
+	}
+	// d/x won't be listed, since only the top level is
+	for _, file := range []string{"a", "b", "d/x", "f"} {
+		requireNoError(t, os.WriteFile(filepath.Join(tempDir, file), nil, 0o644))
+	}
+
+	srcs, err := listEntries(d, 1)
+	requireNoError(t, err)
+	ids, err := snapshot(d, srcs)
+	requireNoError(t, err)
+	listed := listedDirs(srcs, ids, 1)
+
+	tests := []struct {
+		description      string
+		srcToDst         map[string]string
+		creates          map[string]bool
+		deleted          []string
+		expectedProblems []string
+	}{
+		{
+			description: "valid",
+			srcToDst:    map[string]string{"a": "e/a", "b": "a", "d": "d2"},
+			creates:     map[string]bool{"g": true, "g/h": false},
+		},
+		{
+			description:      "empty",
+			srcToDst:         map[string]string{"a": ""},
+			expectedProblems: []string{`empty destination for "a"`},
+		},
+		{
+			description: "invalid names",
+			srcToDst:    map[string]string{"a": "e/..", "b": "x\x00y"},
+			expectedProblems: []string{
+				`destination "e/.." isn't a valid name`,
+				`destination "x\x00y" contains a NUL byte`,
+			},
+		},
+		{
+			description: "used as directories",
+			srcToDst:    map[string]string{"a": "z/", "b": "b/../q", "d": "e/../d2/"},
+			expectedProblems: []string{
+				`"z" won't be a directory, but "z/" uses it as one`,
+				`"b" won't be a directory, but "b/../q" uses it as one`,
+			},
+		},
+		{
+			description: "too long",
+			srcToDst: map[string]string{
+				"a": strings.Repeat("x", nameMax+1),
+				"b": strings.Repeat("x/", pathMax/2+1),
+			},
+			expectedProblems: []string{
+				fmt.Sprintf(`destination %q contains a name longer than %d bytes`,
+					strings.Repeat("x", nameMax+1), nameMax),
+				fmt.Sprintf(`destination %q is longer than %d bytes`,
+					strings.Repeat("x/", pathMax/2+1), pathMax),
+			},
+		},
+		{
+			description: "missing parents",
+			srcToDst:    map[string]string{"a": "n/a", "b": "f/b", "d": "d2"},
+			creates:     map[string]bool{"d/y": false},
+			expectedProblems: []string{
+				`parent directory of "n/a" won't exist`,
+				`parent of "f/b" won't be a directory`,
+				`parent directory of "d/y" won't exist`,
+			},
+		},
+		{
+			description: "parents moved or created",
+			srcToDst:    map[string]string{"a": "d2/a", "b": "g/b", "d": "d2", "f": "a"},
+			creates:     map[string]bool{"f": true, "f/c": false, "g": true},
+		},
+		{
+			description:      "parent deleted",
+			srcToDst:         map[string]string{"a": "e/a"},
+			deleted:          []string{"e"},
+			expectedProblems: []string{`parent directory of "e/a" won't exist`},
+		},
+		{
+			description:      "unlisted contents deleted",
+			deleted:          []string{"d"},
+			expectedProblems: []string{`cannot delete "d", since "d/x" wasn't listed`},
+		},
+		{
+			description:      "unlisted",
+			srcToDst:         map[string]string{"a": "d/x"},
+			expectedProblems: []string{`"d/x" already exists`},
+		},
+		{
+			description:      "unlisted moved along",
+			srcToDst:         map[string]string{"b": "d2/x", "d": "d2"},
+			expectedProblems: []string{`"d2/x" already exists`},
+		},
+		{
+			description: "unlisted moved away",
+			srcToDst:    map[string]string{"a": "d/x", "d": "d2"},
+			creates:     map[string]bool{"d": true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			srcToDst := map[string]string{}
+			for _, src := range srcs {
+				srcToDst[src] = src
+			}
+			written := map[string]string{}
+			for src, dst := range test.srcToDst {
+				srcToDst[src] = cleanDst(dst)
+				if srcToDst[src] != dst {
+					written[srcToDst[src]] = dst
+				}
+			}
+			deleted := map[string]struct{}{}
+			for _, src := range test.deleted {
+				deleted[src] = struct{}{}
+				delete(srcToDst, src)
+			}
+
+			problems, err := preflight(d, srcs, listed, srcToDst, written,
+				test.creates, deleted)
+			requireNoError(t, err)
+
+			actualProblems := make([]string, len(problems))
+			for i, p := range problems {
+				actualProblems[i] = p.msg
+			}
+			if fmt.Sprintf("%q", test.expectedProblems) != fmt.Sprintf("%q", actualProblems) {
+				t.Fatalf("expected problems: %q did not match actual problems: %q",
+					test.expectedProblems, actualProblems)
+			}
+		})
+	}
+}
+
+func Test_preflight_unwritable(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("permissions aren't enforced")
+	}
+
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "r"), 0o755))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "r", "a"), nil, 0o644))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "r", "b"), nil, 0o644))
+	requireNoError(t, os.Chmod(filepath.Join(tempDir, "r"), 0o555))
+	t.Cleanup(func() {
+		requireNoError(t, os.Chmod(filepath.Join(tempDir, "r"), 0o755))
+	})
+
+	srcs := []string{"r", "r/a", "r/b"}
+	ids, err := snapshot(d, srcs)
+	requireNoError(t, err)
+
+	problems, err := preflight(d, srcs, listedDirs(srcs, ids, 0),
+		map[string]string{"r": "r", "r/a": "a", "r/b": "b"}, nil, nil, nil)
+	requireNoError(t, err)
+
+	// r is only reported once
+	if len(problems) != 1 || problems[0].msg != `directory "r" isn't writable` {
+		t.Fatalf("expected only r to be unwritable, but problems were: %v",
+			problems)
+	}
+}
+
+func Test_interpretEdit(t *testing.T) {
+	d, tempDir := openTempDir(t)
+	requireNoError(t, os.Mkdir(filepath.Join(tempDir, "e"), 0o755))
+
+	srcs := []string{"a", "b", "d", "d/x", "f"}
+	tests := []struct {
+		description string
+		edit        edit
+		// expected is what's expected of the request, formatted with %v
+		expected        string
+		expectedProblem string
+		expectedLine    int
+	}{
+		{
+			description: "cleaned",
+			edit: edit{dsts: []string{"./a2", "b/", "d", "d/x", "f"},
+				deleted: make([]bool, 5), lines: []int{1, 2, 3, 4, 5}},
+			expected: "srcToDst: map[a:a2 b:b d:d d/x:d/x f:f] " +
+				"written: map[a2:./a2 b:b/] toDelete: [] creates: map[]",
+		},
+		{
+			description: "deleted",
+			edit: edit{dsts: []string{"a", "b", "d", "d/x", "f"},
+				deleted: []bool{false, false, true, true, true},
+				lines:   []int{1, 2, 0, 0, 0}},
+			expected: "srcToDst: map[a:a b:b] written: map[] " +
+				"toDelete: [d f] creates: map[]",
+		},
+		{
+			description: "created with parents",
+			edit: edit{dsts: srcs, deleted: make([]bool, 5),
+				creates: []string{"e/n/m/", "e/o"}, createLines: []int{6, 7}},
+			expected: "srcToDst: map[a:a b:b d:d d/x:d/x f:f] " +
+				"written: map[e/n/m:e/n/m/] toDelete: [] " +
+				"creates: map[e/n:true e/n/m:true e/o:false]",
+		},
+		{
+			description: "duplicate written differently",
+			edit: edit{dsts: []string{"x", "./x", "d", "d/x", "f"},
+				deleted: make([]bool, 5), lines: []int{1, 2, 3, 4, 5}},
+			expectedProblem: `duplicate destination "x"`,
+			expectedLine:    2,
+		},
+		{
+			description: "duplicate created",
+			edit: edit{dsts: srcs, deleted: make([]bool, 5),
+				lines: []int{1, 2, 3, 4, 5}, creates: []string{"f"},
+				createLines: []int{6}},
+			expectedProblem: `duplicate destination "f"`,
+			expectedLine:    6,
+		},
+		{
+			description: "contents kept",
+			edit: edit{dsts: srcs, deleted: []bool{false, false, true, false, false},
+				lines: []int{1, 2, 0, 3, 4}},
+			expectedProblem: `cannot delete "d" without deleting "d/x"`,
+			expectedLine:    3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r, problems := interpretEdit(d, srcs, test.edit)
+			if test.expectedProblem != "" {
+				if len(problems) != 1 || problems[0].msg != test.expectedProblem ||
+					r.line(problems[0]) != test.expectedLine {
+					t.Fatalf("expected problem: %q on line %d, but problems "+
+						"were: %v", test.expectedProblem, test.expectedLine,
+						problems)
+				}
+				return
+			}
+
+			if len(problems) > 0 {
+				t.Fatalf("expected no problems, but problems were: %v",
+					problems)
+			}
+			actual := fmt.Sprintf("srcToDst: %v written: %v toDelete: %v "+
+				"creates: %v", r.srcToDst, r.written, r.toDelete, r.creates)
+			if test.expected != actual {
+				t.Fatalf("expected request: %s did not match actual request: %s",
+					test.expected, actual)
+			}
+		})
+	}
+}
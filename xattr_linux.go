@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyXattrs copies the extended attributes of src to dst, neither of which
+// may be a symlink. Attributes that dst's filesystem doesn't support, or that
+// we're not allowed to set, such as those in the trusted namespace, are
+// skipped.
+func (d *dir) copyXattrs(src, dst string) error {
+	in, err := d.open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := d.open(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	names, err := xattrList(int(in.Fd()))
+	if err == unix.ENOTSUP {
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "flistxattr", Path: src, Err: err}
+	}
+
+	for _, name := range names {
+		value, err := xattrGet(int(in.Fd()), name)
+		if err != nil {
+			return &os.PathError{Op: "fgetxattr", Path: src, Err: err}
+		}
+
+		err = unix.Fsetxattr(int(out.Fd()), name, value, 0)
+		if err == unix.ENOTSUP || err == unix.EPERM {
+			continue
+		} else if err != nil {
+			return &os.PathError{Op: "fsetxattr", Path: dst, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// xattrList returns the names of the extended attributes of fd.
+func xattrList(fd int) ([]string, error) {
+	for {
+		size, err := unix.Flistxattr(fd, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Flistxattr(fd, buf)
+		// more attributes may have been added in between
+		if err == unix.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// xattrGet returns the value of the extended attribute name of fd.
+func xattrGet(fd int, name string) ([]byte, error) {
+	for {
+		size, err := unix.Fgetxattr(fd, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Fgetxattr(fd, name, buf)
+		// the value may have grown in between
+		if err == unix.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
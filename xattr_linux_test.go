@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func Test_dir_copyXattrs(t *testing.T) {
+	d, tempDir := openTempDir(t)
+
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "a"), nil, 0o644))
+	requireNoError(t, os.WriteFile(filepath.Join(tempDir, "b"), nil, 0o644))
+	err := unix.Setxattr(filepath.Join(tempDir, "a"), "user.vimv2", []byte("x"), 0)
+	if err == unix.ENOTSUP {
+		t.Skip("extended attributes aren't supported by the filesystem")
+	}
+	requireNoError(t, err)
+
+	requireNoError(t, d.copyXattrs("a", "b"))
+
+	buf := make([]byte, 16)
+	n, err := unix.Getxattr(filepath.Join(tempDir, "b"), "user.vimv2", buf)
+	requireNoError(t, err)
+	if string(buf[:n]) != "x" {
+		t.Fatalf("expected user.vimv2 to be: %q but it was: %q", "x", buf[:n])
+	}
+}